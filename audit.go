@@ -0,0 +1,407 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditLogMaxSize    = 100 << 20
+	defaultAuditLogMaxBackups = 5
+)
+
+// auditEntry is one record of the audit log. Token values are never
+// recorded, only their accessors.
+type auditEntry struct {
+	Time           time.Time `json:"time"`
+	Seq            uint64    `json:"seq"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	SourceIP       string    `json:"source_ip,omitempty"`
+	ServiceAccount string    `json:"service_account,omitempty"`
+	Namespace      string    `json:"namespace"`
+	Name           string    `json:"name"`
+	PodUID         string    `json:"pod_uid,omitempty"`
+	PodIP          string    `json:"pod_ip,omitempty"`
+
+	RequestedPolicies []string `json:"requested_policies,omitempty"`
+	Policies          []string `json:"policies,omitempty"`
+	Role              string   `json:"role,omitempty"`
+	RequestedTTL      string   `json:"requested_ttl,omitempty"`
+	TTL               string   `json:"ttl,omitempty"`
+	WrapTTL           string   `json:"wrap_ttl,omitempty"`
+	Accessor          string   `json:"accessor,omitempty"`
+	WrappingAccessor  string   `json:"wrapping_accessor,omitempty"`
+
+	Decision  string  `json:"decision"`
+	Reason    string  `json:"reason,omitempty"`
+	Code      int     `json:"code,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+
+	// PrevHash is the hash of the previous record, or the genesis hash for
+	// the first one, and Hash the HMAC-SHA256 of this record with Hash
+	// empty, chaining every record to the ones before it.
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+
+	start time.Time
+}
+
+// newAuditEntry starts the audit record of a request.
+func newAuditEntry(r *http.Request) auditEntry {
+	return auditEntry{RemoteAddr: r.RemoteAddr, start: time.Now()}
+}
+
+// finish records the outcome of a request from its status code and error,
+// unless a decision was already made.
+func (e *auditEntry) finish(code int, err error) {
+	e.Code = code
+	if e.Decision == "" {
+		switch {
+		case err == nil:
+			e.Decision = "allow"
+		case code == 401 || code == 403:
+			e.Decision = "deny"
+		case code == 429 || code == 503:
+			e.Decision = "throttle"
+		default:
+			e.Decision = "error"
+		}
+	}
+	if e.Reason == "" && err != nil {
+		e.Reason = err.Error()
+	}
+}
+
+// auditLog receives every audit record. It writes to stdout until main
+// configures it.
+var auditLog = &auditSink{w: os.Stdout}
+
+// auditKey keys the hash chain, so the chain can only be rebuilt by someone
+// holding the key. Without a key records are hashed with plain SHA-256.
+var auditKey []byte
+
+// auditCheckpoint identifies a record in the chain by its sequence number
+// and hash.
+type auditCheckpoint struct {
+	Seq  uint64
+	Hash string
+}
+
+// genesisCheckpoint is what the first record of a chain follows.
+func genesisCheckpoint() auditCheckpoint {
+	return auditCheckpoint{Seq: 0, Hash: auditMAC([]byte("vault-controller audit log genesis"))}
+}
+
+// parseAuditCheckpoint parses a checkpoint written as <seq>:<hash>.
+func parseAuditCheckpoint(s string) (auditCheckpoint, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return auditCheckpoint{}, fmt.Errorf("invalid checkpoint %q; want <seq>:<hash>", s)
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return auditCheckpoint{}, fmt.Errorf("invalid checkpoint %q; want <seq>:<hash>", s)
+	}
+	return auditCheckpoint{Seq: seq, Hash: parts[1]}, nil
+}
+
+func (c auditCheckpoint) String() string {
+	return fmt.Sprintf("%d:%s", c.Seq, c.Hash)
+}
+
+func audit(e auditEntry) {
+	if err := auditLog.Write(&e); err != nil {
+		log.Printf("audit: error writing entry: %s", err)
+	}
+}
+
+// auditSink writes hash-chained audit records, one JSON object per line,
+// to stdout or to a file that is rotated once it reaches maxSize.
+type auditSink struct {
+	sync.Mutex
+	w          io.Writer
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	seq      uint64
+	prevHash string
+	// broken is set when a failed write left a partial record in the file
+	// that could not be removed. Appending to it would break the chain.
+	broken error
+}
+
+// newAuditSink returns the sink described by spec, either "stdout" or
+// file:<path>. The hash chain of an existing file is continued.
+func newAuditSink(spec string, maxSize int64, maxBackups int) (*auditSink, error) {
+	if spec == "" || spec == "stdout" {
+		return &auditSink{w: os.Stdout, prevHash: genesisCheckpoint().Hash}, nil
+	}
+	if !strings.HasPrefix(spec, "file:") || spec == "file:" {
+		return nil, fmt.Errorf("invalid audit log %q", spec)
+	}
+	s := &auditSink{
+		path:       strings.TrimPrefix(spec, "file:"),
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	last, err := lastAuditEntry(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	if last == nil && maxBackups > 0 {
+		// The controller may have stopped right after a rotation, before
+		// anything was written to the new file.
+		if last, err = lastAuditEntry(s.path + ".1"); err != nil {
+			return nil, fmt.Errorf("audit: %v", err)
+		}
+	}
+	if last != nil {
+		s.seq = last.Seq
+		s.prevHash = last.Hash
+	} else {
+		s.prevHash = genesisCheckpoint().Hash
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write assigns the record its place in the chain and writes it.
+func (s *auditSink) Write(e *auditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.broken != nil {
+		return s.broken
+	}
+	e.Time = time.Now().UTC()
+	if !e.start.IsZero() {
+		e.LatencyMS = float64(time.Since(e.start)) / float64(time.Millisecond)
+	}
+	if s.prevHash == "" {
+		s.prevHash = genesisCheckpoint().Hash
+	}
+	e.Seq = s.seq + 1
+	e.PrevHash = s.prevHash
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if s.file != nil && s.maxSize > 0 && s.size+int64(len(data)) > s.maxSize && s.size > 0 {
+		// The record is not dropped when rotation fails; the current file
+		// just grows past maxSize until a rotation succeeds.
+		if err := s.rotate(); err != nil {
+			log.Printf("audit: error rotating %s: %v", s.path, err)
+		}
+	}
+	w := s.w
+	if s.path != "" {
+		if s.file == nil {
+			return fmt.Errorf("audit: %s is not open", s.path)
+		}
+		w = s.file
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		if s.file != nil && n > 0 {
+			// Drop the partial record so the next one starts on a line of
+			// its own.
+			if terr := s.file.Truncate(s.size); terr != nil {
+				s.broken = fmt.Errorf("audit: %s holds a partial record and is no longer written: %v", s.path, terr)
+			}
+		}
+		return err
+	}
+	s.size += int64(n)
+	s.seq = e.Seq
+	s.prevHash = e.Hash
+	return nil
+}
+
+func (s *auditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: %v", err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to <path>.1, shifting older files up and
+// dropping the oldest, and starts a new file. The chain carries on into the
+// new file. The current file stays open until the new one is, so a failed
+// rotation leaves records going to the current file.
+func (s *auditSink) rotate() error {
+	for i := s.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("audit: %v", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	old := s.file
+	if err := s.open(); err != nil {
+		return err
+	}
+	if err := old.Close(); err != nil {
+		log.Printf("audit: error closing rotated file: %v", err)
+	}
+	// Rotation drops the oldest file, so the checkpoint is logged for
+	// verifying the files that are left.
+	log.Printf("audit: rotated %s at checkpoint %s", s.path, auditCheckpoint{s.seq, s.prevHash})
+	return nil
+}
+
+// computeHash returns the hash of the record with Hash empty.
+func (e auditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return "", err
+	}
+	return auditMAC(data), nil
+}
+
+// auditMAC returns the HMAC-SHA256 of data keyed with auditKey, or its
+// SHA-256 when there is no key.
+func auditMAC(data []byte) string {
+	if len(auditKey) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, auditKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// lastAuditEntry returns the last record in the file, or nil when the file
+// is missing or empty.
+func lastAuditEntry(path string) (*auditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var e auditEntry
+	if err := json.Unmarshal(last, &e); err != nil {
+		return nil, fmt.Errorf("error parsing last record of %s: %v", path, err)
+	}
+	return &e, nil
+}
+
+// verifyAuditLog checks the hash chain of the audit log read from r. The
+// first record must directly follow from, and from is advanced to the last
+// record read.
+func verifyAuditLog(r io.Reader, from *auditCheckpoint) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if e.Seq != from.Seq+1 {
+			return fmt.Errorf("line %d: expected seq %d, found %d; records are missing or out of order", line, from.Seq+1, e.Seq)
+		}
+		if e.PrevHash != from.Hash {
+			return fmt.Errorf("line %d (seq %d): chain broken; previous hash does not match", line, e.Seq)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+			return fmt.Errorf("line %d (seq %d): record was modified", line, e.Seq)
+		}
+		*from = auditCheckpoint{Seq: e.Seq, Hash: e.Hash}
+	}
+	return scanner.Err()
+}
+
+// verifyAuditLogFiles verifies the given audit log files, oldest first,
+// starting from the given checkpoint, and returns the checkpoint of the
+// last record.
+func verifyAuditLogFiles(paths []string, from auditCheckpoint) (auditCheckpoint, error) {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return from, err
+		}
+		err = verifyAuditLog(f, &from)
+		f.Close()
+		if err != nil {
+			return from, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return from, nil
+}
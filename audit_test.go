@@ -0,0 +1,217 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditLines returns n chained records, one per line.
+func auditLines(t *testing.T, n int) []string {
+	var buf bytes.Buffer
+	s := &auditSink{w: &buf}
+	for i := 0; i < n; i++ {
+		if err := s.Write(&auditEntry{Namespace: "default", Name: "web", Decision: "allow"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	defer func(key []byte) { auditKey = key }(auditKey)
+	auditKey = []byte("test key")
+
+	lines := auditLines(t, 4)
+	withoutLine := func(i int) string {
+		return strings.Join(append(append([]string{}, lines[:i]...), lines[i+1:]...), "")
+	}
+
+	tests := []struct {
+		name    string
+		log     string
+		from    auditCheckpoint
+		wantErr string
+	}{
+		{"intact", strings.Join(lines, ""), genesisCheckpoint(), ""},
+		{"empty", "", genesisCheckpoint(), ""},
+		{"head dropped", withoutLine(0), genesisCheckpoint(), "expected seq 1, found 2"},
+		{"middle dropped", withoutLine(2), genesisCheckpoint(), "expected seq 3, found 4"},
+		{"reordered", lines[1] + lines[0], genesisCheckpoint(), "expected seq 1, found 2"},
+		{"modified", strings.Replace(strings.Join(lines, ""), `"decision":"allow"`, `"decision":"deny"`, 1), genesisCheckpoint(), "record was modified"},
+		{"wrong genesis", strings.Join(lines, ""), auditCheckpoint{Seq: 0, Hash: "bogus"}, "chain broken"},
+		{"not json", "garbage\n", genesisCheckpoint(), "line 1"},
+	}
+	for _, tt := range tests {
+		from := tt.from
+		err := verifyAuditLog(strings.NewReader(tt.log), &from)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVerifyAuditLogCheckpoints(t *testing.T) {
+	defer func(key []byte) { auditKey = key }(auditKey)
+	auditKey = []byte("test key")
+
+	lines := auditLines(t, 4)
+
+	// The last record is only missed when checked against a checkpoint.
+	from := genesisCheckpoint()
+	if err := verifyAuditLog(strings.NewReader(strings.Join(lines[:3], "")), &from); err != nil {
+		t.Fatal(err)
+	}
+	full := genesisCheckpoint()
+	if err := verifyAuditLog(strings.NewReader(strings.Join(lines, "")), &full); err != nil {
+		t.Fatal(err)
+	}
+	if from == full || full.Seq != 4 {
+		t.Errorf("truncated log ends at %s, full log at %s", from, full)
+	}
+
+	// A log whose head was rotated away verifies from a checkpoint.
+	mid := genesisCheckpoint()
+	verifyAuditLog(strings.NewReader(strings.Join(lines[:2], "")), &mid)
+	if err := verifyAuditLog(strings.NewReader(strings.Join(lines[2:], "")), &mid); err != nil {
+		t.Errorf("verifying from checkpoint: %v", err)
+	}
+	if mid != full {
+		t.Errorf("got %s, want %s", mid, full)
+	}
+
+	c, err := parseAuditCheckpoint(full.String())
+	if err != nil || c != full {
+		t.Errorf("parseAuditCheckpoint(%q) = %v, %v", full.String(), c, err)
+	}
+	for _, s := range []string{"", "4", "x:abc", "4:"} {
+		if _, err := parseAuditCheckpoint(s); err == nil {
+			t.Errorf("parseAuditCheckpoint(%q) succeeded", s)
+		}
+	}
+}
+
+func TestVerifyAuditLogKey(t *testing.T) {
+	defer func(key []byte) { auditKey = key }(auditKey)
+	auditKey = []byte("test key")
+	log := strings.Join(auditLines(t, 2), "")
+
+	auditKey = []byte("other key")
+	from := genesisCheckpoint()
+	if err := verifyAuditLog(strings.NewReader(log), &from); err == nil {
+		t.Error("chain verified with the wrong key")
+	}
+}
+
+func TestAuditSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	s, err := newAuditSink("file:"+path, 400, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.Write(&auditEntry{Namespace: "default", Name: "web", Decision: "allow"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.file.Close()
+
+	// A restarted controller continues the chain.
+	s, err = newAuditSink("file:"+path, 400, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(&auditEntry{Namespace: "default", Name: "web", Decision: "deny"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// So does one restarted right after a rotation, before the new file
+	// has any records.
+	if err := s.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+	s, err = newAuditSink("file:"+path, 400, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.seq != 5 {
+		t.Errorf("restarted after rotation at seq %d, want 5", s.seq)
+	}
+	if err := s.Write(&auditEntry{Namespace: "default", Name: "web", Decision: "deny"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for i := 5; i > 0; i-- {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", path, i)); err == nil {
+			paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+		}
+	}
+	if len(paths) == 0 {
+		t.Fatal("audit log was not rotated")
+	}
+	last, err := verifyAuditLogFiles(append(paths, path), genesisCheckpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 6 {
+		t.Errorf("last record is %s, want seq 6", last)
+	}
+}
+
+func TestAuditSinkFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	s, err := newAuditSink("file:"+path, 400, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A directory in the way of <path>.1 makes every rotation fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := s.Write(&auditEntry{Namespace: "default", Name: "web", Decision: "allow"}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if s.file == nil {
+		t.Fatal("audit file closed after a failed rotation")
+	}
+	if _, err := verifyAuditLogFiles([]string{path}, genesisCheckpoint()); err != nil {
+		t.Fatal(err)
+	}
+}
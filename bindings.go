@@ -0,0 +1,296 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	bindingsPath              = "/apis/vaultproject.io/v1alpha1/vaultpolicybindings"
+	bindingStatusSyncInterval = time.Minute
+)
+
+// bindingCache is a list/watch backed cache of VaultPolicyBinding objects.
+type bindingCache struct {
+	client *kubernetesClient
+
+	// selectionChanged is signalled when a binding is added, removed or
+	// selects different pods.
+	selectionChanged chan struct{}
+
+	sync.RWMutex
+	bindings map[string]*VaultPolicyBinding
+	synced   bool
+	// issued holds the last issuance time of each binding until it is
+	// written to the binding status.
+	issued map[string]time.Time
+}
+
+func newBindingCache(client *kubernetesClient) *bindingCache {
+	return &bindingCache{
+		client:           client,
+		selectionChanged: make(chan struct{}, 1),
+		bindings:         make(map[string]*VaultPolicyBinding),
+		issued:           make(map[string]time.Time),
+	}
+}
+
+// SelectionChanged returns a channel that receives a value when the set of
+// pods selected by the bindings may have changed. Pods are cached based on
+// the bindings that select them, so the pod cache relists when it fires.
+// A nil cache returns a nil channel.
+func (bc *bindingCache) SelectionChanged() <-chan struct{} {
+	if bc == nil {
+		return nil
+	}
+	return bc.selectionChanged
+}
+
+func (bc *bindingCache) notifySelectionChanged() {
+	select {
+	case bc.selectionChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the cache in sync with the API server, writes the
+// lastIssuanceTime status of bindings used for issuance and, on the
+// leader, keeps the matchedPods status of every binding up to date.
+func (bc *bindingCache) Run(done <-chan struct{}) {
+	r := &reflector{
+		client:  bc.client,
+		name:    "policy binding cache",
+		path:    bindingsPath,
+		replace: bc.replace,
+		apply:   bc.apply,
+	}
+	go r.Run(done)
+
+	ticker := time.NewTicker(bindingStatusSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			bc.flushIssuances()
+			if elector.IsLeader() {
+				bc.syncStatus()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// WaitForSync blocks until the first list has completed so pods are not
+// evaluated against an empty set of bindings.
+func (bc *bindingCache) WaitForSync(done <-chan struct{}) bool {
+	for {
+		bc.RLock()
+		synced := bc.synced
+		bc.RUnlock()
+		if synced {
+			return true
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (bc *bindingCache) replace(items []json.RawMessage) error {
+	bindings := make(map[string]*VaultPolicyBinding)
+	for _, item := range items {
+		var b VaultPolicyBinding
+		if err := json.Unmarshal(item, &b); err != nil {
+			return err
+		}
+		bindings[podKey(b.Metadata.Namespace, b.Metadata.Name)] = &b
+	}
+	bc.Lock()
+	changed := bc.synced && len(bindings) != len(bc.bindings)
+	for key, b := range bindings {
+		if old, ok := bc.bindings[key]; bc.synced && (!ok || !sameSelection(old, b)) {
+			changed = true
+		}
+	}
+	bc.bindings = bindings
+	bc.synced = true
+	bc.Unlock()
+	if changed {
+		bc.notifySelectionChanged()
+	}
+	return nil
+}
+
+func (bc *bindingCache) apply(eventType string, object json.RawMessage) error {
+	var b VaultPolicyBinding
+	if err := json.Unmarshal(object, &b); err != nil {
+		return err
+	}
+	key := podKey(b.Metadata.Namespace, b.Metadata.Name)
+	bc.Lock()
+	old, ok := bc.bindings[key]
+	// Status updates do not change which pods are selected.
+	changed := eventType == "DELETED" || !ok || !sameSelection(old, &b)
+	if eventType == "DELETED" {
+		delete(bc.bindings, key)
+	} else {
+		bc.bindings[key] = &b
+	}
+	bc.Unlock()
+	if changed {
+		bc.notifySelectionChanged()
+	}
+	return nil
+}
+
+// sameSelection reports whether a and b select the same pods.
+func sameSelection(a, b *VaultPolicyBinding) bool {
+	return reflect.DeepEqual(a.Spec.PodSelector, b.Spec.PodSelector) &&
+		reflect.DeepEqual(a.Spec.ServiceAccountNames, b.Spec.ServiceAccountNames)
+}
+
+// Match returns the bindings in the pod namespace that select the pod,
+// ordered by name. A nil cache matches nothing.
+func (bc *bindingCache) Match(pod *Pod) []*VaultPolicyBinding {
+	if bc == nil {
+		return nil
+	}
+	var matched []*VaultPolicyBinding
+	bc.RLock()
+	for _, b := range bc.bindings {
+		if b.Metadata.Namespace == pod.Metadata.Namespace && b.selects(pod) {
+			matched = append(matched, b)
+		}
+	}
+	bc.RUnlock()
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Metadata.Name < matched[j].Metadata.Name
+	})
+	return matched
+}
+
+// selects reports whether the binding applies to the pod. Both the label
+// selector and the service account list must match when set; a binding
+// with neither selects every pod in its namespace.
+func (b *VaultPolicyBinding) selects(pod *Pod) bool {
+	if b.Spec.PodSelector != nil {
+		for k, v := range b.Spec.PodSelector.MatchLabels {
+			if pod.Metadata.Labels[k] != v {
+				return false
+			}
+		}
+	}
+	if len(b.Spec.ServiceAccountNames) > 0 {
+		for _, sa := range b.Spec.ServiceAccountNames {
+			if sa == pod.Spec.ServiceAccountName {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// RecordIssuance records t as the last issuance time of the named
+// bindings. The lastIssuanceTime status is written by flushIssuances so
+// token requests never wait on the API server.
+func (bc *bindingCache) RecordIssuance(namespace string, names []string, t time.Time) {
+	if bc == nil {
+		return
+	}
+	bc.Lock()
+	for _, name := range names {
+		key := podKey(namespace, name)
+		if t.After(bc.issued[key]) {
+			bc.issued[key] = t
+		}
+	}
+	bc.Unlock()
+}
+
+// flushIssuances writes the recorded issuance times to the lastIssuanceTime
+// status, one update per binding. Times that fail to be written are kept
+// for the next flush unless a later one was recorded meanwhile.
+func (bc *bindingCache) flushIssuances() {
+	bc.Lock()
+	issued := bc.issued
+	bc.issued = make(map[string]time.Time)
+	var flush []*VaultPolicyBinding
+	for key := range issued {
+		if b, ok := bc.bindings[key]; ok {
+			flush = append(flush, b)
+		}
+	}
+	bc.Unlock()
+
+	for _, b := range flush {
+		key := podKey(b.Metadata.Namespace, b.Metadata.Name)
+		patch := map[string]interface{}{
+			"status": map[string]interface{}{
+				"lastIssuanceTime": issued[key].UTC().Format(time.RFC3339),
+			},
+		}
+		if err := bc.patchStatus(b.Metadata.Namespace, b.Metadata.Name, patch); err != nil {
+			log.Printf("policy binding cache: error updating status of %s: %v", key, err)
+			bc.RecordIssuance(b.Metadata.Namespace, []string{b.Metadata.Name}, issued[key])
+		}
+	}
+}
+
+// syncStatus updates the matchedPods status of bindings whose count of
+// running pods has changed.
+func (bc *bindingCache) syncStatus() {
+	counts := make(map[string]int)
+	podStore.Resync(func(eventType string, pod *Pod) {
+		if podTerminated(pod) {
+			return
+		}
+		for _, b := range bc.Match(pod) {
+			counts[podKey(b.Metadata.Namespace, b.Metadata.Name)]++
+		}
+	})
+
+	bc.RLock()
+	var stale []*VaultPolicyBinding
+	for key, b := range bc.bindings {
+		if b.Status.MatchedPods != counts[key] {
+			stale = append(stale, b)
+		}
+	}
+	bc.RUnlock()
+
+	for _, b := range stale {
+		patch := map[string]interface{}{
+			"status": map[string]interface{}{
+				"matchedPods": counts[podKey(b.Metadata.Namespace, b.Metadata.Name)],
+			},
+		}
+		if err := bc.patchStatus(b.Metadata.Namespace, b.Metadata.Name, patch); err != nil {
+			log.Printf("policy binding cache: error updating status of %s: %v", podKey(b.Metadata.Namespace, b.Metadata.Name), err)
+		}
+	}
+}
+
+func (bc *bindingCache) patchStatus(namespace, name string, patch interface{}) error {
+	path := fmt.Sprintf("/apis/vaultproject.io/v1alpha1/namespaces/%s/vaultpolicybindings/%s/status", namespace, name)
+	return bc.client.mergePatch(path, patch, nil)
+}
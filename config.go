@@ -0,0 +1,358 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/ghodss/yaml"
+)
+
+// Config is the controller configuration file, written in YAML or JSON.
+type Config struct {
+	// PolicyCeilings limits the Vault policies and token roles pods may
+	// request. When no ceilings are configured anything may be requested.
+	PolicyCeilings []PolicyCeiling `json:"policyCeilings"`
+
+	// TokenDefaults apply when neither the pod nor a binding sets a value.
+	TokenDefaults TokenDefaults `json:"tokenDefaults"`
+
+	// TokenLimits are the maximums requested values are clamped to.
+	TokenLimits TokenLimits `json:"tokenLimits"`
+
+	// TokenMetadata controls the extra metadata attached to tokens.
+	TokenMetadata TokenMetadata `json:"tokenMetadata"`
+
+	// Vaults lists the Vault backends pods can select with the
+	// vaultproject.io/vault annotation. When empty a single backend is
+	// configured from the environment.
+	Vaults []VaultConfig `json:"vaults"`
+
+	// DefaultVault names the backend used by pods without the annotation;
+	// defaults to the first entry of Vaults.
+	DefaultVault string `json:"defaultVault"`
+
+	// VaultNamespaces maps Kubernetes namespaces to Vault Enterprise
+	// namespaces.
+	VaultNamespaces VaultNamespaces `json:"vaultNamespaces"`
+
+	// RateLimits limits how often pods may request tokens and how much
+	// work the controller takes on at once.
+	RateLimits RateLimits `json:"rateLimits"`
+}
+
+// RateLimits holds the token request limits. Unset values use the
+// defaults below.
+type RateLimits struct {
+	// Pod and Namespace are token buckets keyed by pod UID and by
+	// namespace.
+	Pod       TokenBucket `json:"pod"`
+	Namespace TokenBucket `json:"namespace"`
+
+	// PushWorkers bounds the number of concurrent pushes to vault-init.
+	PushWorkers int `json:"pushWorkers"`
+
+	// MaxInFlightCreates bounds the number of concurrent token create and
+	// secret read calls to Vault across all backends.
+	MaxInFlightCreates int `json:"maxInFlightCreates"`
+}
+
+// TokenBucket allows Burst requests at once, refilled at Requests per Per.
+type TokenBucket struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+	Burst    int    `json:"burst"`
+}
+
+var defaultRateLimits = RateLimits{
+	Pod:                TokenBucket{Requests: 6, Per: "1m", Burst: 3},
+	Namespace:          TokenBucket{Requests: 300, Per: "1m", Burst: 50},
+	PushWorkers:        32,
+	MaxInFlightCreates: 16,
+}
+
+// withDefaults returns the limits with unset values replaced by the
+// defaults.
+func (l RateLimits) withDefaults() RateLimits {
+	l.Pod = l.Pod.withDefaults(defaultRateLimits.Pod)
+	l.Namespace = l.Namespace.withDefaults(defaultRateLimits.Namespace)
+	if l.PushWorkers == 0 {
+		l.PushWorkers = defaultRateLimits.PushWorkers
+	}
+	if l.MaxInFlightCreates == 0 {
+		l.MaxInFlightCreates = defaultRateLimits.MaxInFlightCreates
+	}
+	return l
+}
+
+func (b TokenBucket) withDefaults(d TokenBucket) TokenBucket {
+	if b.Requests == 0 {
+		b.Requests = d.Requests
+	}
+	if b.Per == "" {
+		b.Per = d.Per
+	}
+	if b.Burst == 0 {
+		b.Burst = d.Burst
+	}
+	return b
+}
+
+// VaultNamespaces maps a Kubernetes namespace to the Vault namespace its
+// tokens are created in. Namespaces listed in Table map to the given Vault
+// namespace. Otherwise, when Mirror is set, a Kubernetes namespace maps to
+// the Vault namespace of the same name below Parent; when it is not, to
+// Parent itself. An empty result means the namespace of the controller's
+// own Vault client.
+type VaultNamespaces struct {
+	Mirror bool              `json:"mirror"`
+	Parent string            `json:"parent"`
+	Table  map[string]string `json:"table"`
+}
+
+// vaultNamespace returns the Vault namespace for the Kubernetes namespace.
+func (c *Config) vaultNamespace(namespace string) string {
+	m := c.VaultNamespaces
+	if ns, ok := m.Table[namespace]; ok {
+		return ns
+	}
+	if m.Mirror {
+		return path.Join(m.Parent, namespace)
+	}
+	return m.Parent
+}
+
+// VaultConfig describes a Vault backend.
+type VaultConfig struct {
+	Name          string          `json:"name"`
+	Address       string          `json:"address"`
+	CACert        string          `json:"caCert"`
+	TLSServerName string          `json:"tlsServerName"`
+	WrapTTL       string          `json:"wrapTTL"`
+	Auth          VaultAuthConfig `json:"auth"`
+}
+
+// VaultAuthConfig selects how the controller authenticates with a Vault
+// backend: token (the default), approle or kubernetes. Credentials are read
+// from files so they can be mounted from Kubernetes Secrets.
+type VaultAuthConfig struct {
+	Method string `json:"method"`
+
+	// Token auth. Token can only be set through VAULT_TOKEN.
+	Token     string `json:"-"`
+	TokenFile string `json:"tokenFile"`
+
+	// AppRole auth. SecretID can only be set through
+	// VAULT_APPROLE_SECRET_ID.
+	RoleID       string `json:"roleID"`
+	SecretID     string `json:"-"`
+	SecretIDFile string `json:"secretIDFile"`
+
+	// Kubernetes auth.
+	Role    string `json:"role"`
+	JWTFile string `json:"jwtFile"`
+
+	// Mount is the path the auth method is mounted at.
+	Mount string `json:"mount"`
+}
+
+// TokenMetadata lists the cluster name and the pod labels copied into the
+// metadata of every token.
+type TokenMetadata struct {
+	ClusterName string   `json:"clusterName"`
+	Labels      []string `json:"labels"`
+}
+
+// TokenDefaults are the token settings used when a pod does not request
+// its own. Durations take a number of seconds or a duration such as "72h".
+type TokenDefaults struct {
+	TTL            string `json:"ttl"`
+	Period         string `json:"period"`
+	ExplicitMaxTTL string `json:"explicitMaxTTL"`
+	NumUses        int    `json:"numUses"`
+	Renewable      *bool  `json:"renewable"`
+}
+
+// TokenLimits caps the token settings pods may request. An unset limit
+// does not restrict anything. When MaxExplicitMaxTTL or MaxNumUses is set
+// every token gets an explicit max TTL or a use limit.
+type TokenLimits struct {
+	MaxTTL            string `json:"maxTTL"`
+	MaxPeriod         string `json:"maxPeriod"`
+	MaxExplicitMaxTTL string `json:"maxExplicitMaxTTL"`
+	MinWrapTTL        string `json:"minWrapTTL"`
+	MaxWrapTTL        string `json:"maxWrapTTL"`
+	MaxNumUses        int    `json:"maxNumUses"`
+	ForceNonRenewable bool   `json:"forceNonRenewable"`
+}
+
+// PolicyCeiling grants the listed policies and token roles to the pods it
+// matches. A pod matches when it satisfies every criterion that is set;
+// "*" matches any namespace, service account or role. Pod labels are set
+// by whoever creates the pod, so a ceiling with a selector must also name
+// the namespaces or service accounts it applies to.
+type PolicyCeiling struct {
+	Namespaces      []string          `json:"namespaces"`
+	ServiceAccounts []string          `json:"serviceAccounts"`
+	Selector        map[string]string `json:"selector"`
+	Policies        []string          `json:"policies"`
+	Roles           []string          `json:"roles"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+	for i, c := range config.PolicyCeilings {
+		if len(c.Policies) == 0 && len(c.Roles) == 0 {
+			return nil, fmt.Errorf("config: policyCeilings[%d] grants no policies or roles", i)
+		}
+		if len(c.Selector) > 0 && !namesConcrete(c.Namespaces) && !namesConcrete(c.ServiceAccounts) {
+			return nil, fmt.Errorf("config: policyCeilings[%d] has a selector but does not name its namespaces or service accounts; anyone who creates a pod can set its labels", i)
+		}
+	}
+	durations := map[string]string{
+		"tokenDefaults.ttl":             config.TokenDefaults.TTL,
+		"tokenDefaults.period":          config.TokenDefaults.Period,
+		"tokenDefaults.explicitMaxTTL":  config.TokenDefaults.ExplicitMaxTTL,
+		"tokenLimits.maxTTL":            config.TokenLimits.MaxTTL,
+		"tokenLimits.maxPeriod":         config.TokenLimits.MaxPeriod,
+		"tokenLimits.maxExplicitMaxTTL": config.TokenLimits.MaxExplicitMaxTTL,
+		"tokenLimits.minWrapTTL":        config.TokenLimits.MinWrapTTL,
+		"tokenLimits.maxWrapTTL":        config.TokenLimits.MaxWrapTTL,
+	}
+	for field, value := range durations {
+		if _, err := parseDuration(value); err != nil {
+			return nil, fmt.Errorf("config: invalid %s %q: %v", field, value, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, v := range config.Vaults {
+		if v.Name == "" || v.Address == "" {
+			return nil, fmt.Errorf("config: vaults[%d] must have a name and an address", i)
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("config: duplicate vault %q", v.Name)
+		}
+		names[v.Name] = true
+		if d, err := parseDuration(v.WrapTTL); err != nil || (v.WrapTTL != "" && d == 0) {
+			return nil, fmt.Errorf("config: invalid vaults[%d].wrapTTL %q", i, v.WrapTTL)
+		}
+	}
+	if config.DefaultVault != "" && !names[config.DefaultVault] {
+		return nil, fmt.Errorf("config: defaultVault %q is not listed in vaults", config.DefaultVault)
+	}
+	if config.TokenDefaults.NumUses < 0 {
+		return nil, fmt.Errorf("config: tokenDefaults.numUses must not be negative")
+	}
+	if config.TokenLimits.MaxNumUses < 0 {
+		return nil, fmt.Errorf("config: tokenLimits.maxNumUses must not be negative")
+	}
+	buckets := map[string]TokenBucket{
+		"rateLimits.pod":       config.RateLimits.Pod,
+		"rateLimits.namespace": config.RateLimits.Namespace,
+	}
+	for field, b := range buckets {
+		if b.Requests < 0 || b.Burst < 0 {
+			return nil, fmt.Errorf("config: %s must not be negative", field)
+		}
+		if d, err := parseDuration(b.Per); err != nil || (b.Per != "" && d == 0) {
+			return nil, fmt.Errorf("config: invalid %s.per %q", field, b.Per)
+		}
+	}
+	if config.RateLimits.PushWorkers < 0 || config.RateLimits.MaxInFlightCreates < 0 {
+		return nil, fmt.Errorf("config: rateLimits.pushWorkers and rateLimits.maxInFlightCreates must not be negative")
+	}
+	return config, nil
+}
+
+// namesConcrete reports whether names is set and does not contain "*".
+func namesConcrete(names []string) bool {
+	for _, name := range names {
+		if name == "*" {
+			return false
+		}
+	}
+	return len(names) > 0
+}
+
+func (c PolicyCeiling) matches(pod *Pod) bool {
+	if len(c.Namespaces) > 0 && !containsOrWildcard(c.Namespaces, pod.Metadata.Namespace) {
+		return false
+	}
+	if len(c.ServiceAccounts) > 0 && !containsOrWildcard(c.ServiceAccounts, pod.Spec.ServiceAccountName) {
+		return false
+	}
+	for k, v := range c.Selector {
+		if pod.Metadata.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// disallowedPolicies returns the requested policies that no matching
+// ceiling grants to the pod.
+func (c *Config) disallowedPolicies(pod *Pod, requested []string) []string {
+	if len(c.PolicyCeilings) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, ceiling := range c.PolicyCeilings {
+		if !ceiling.matches(pod) {
+			continue
+		}
+		for _, p := range ceiling.Policies {
+			allowed[p] = true
+		}
+	}
+	var disallowed []string
+	for _, p := range requested {
+		if !allowed[p] {
+			disallowed = append(disallowed, p)
+		}
+	}
+	return disallowed
+}
+
+// roleAllowed reports whether a matching ceiling lets the pod create tokens
+// through the named token role.
+func (c *Config) roleAllowed(pod *Pod, role string) bool {
+	if len(c.PolicyCeilings) == 0 {
+		return true
+	}
+	for _, ceiling := range c.PolicyCeilings {
+		if ceiling.matches(pod) && containsOrWildcard(ceiling.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOrWildcard(values []string, s string) bool {
+	for _, v := range values {
+		if v == "*" || v == s {
+			return true
+		}
+	}
+	return false
+}
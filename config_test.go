@@ -0,0 +1,173 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCeilings(t *testing.T) {
+	config := &Config{
+		PolicyCeilings: []PolicyCeiling{
+			{
+				Namespaces: []string{"payments"},
+				Policies:   []string{"payments-read"},
+				Roles:      []string{"payments"},
+			},
+			{
+				Namespaces:      []string{"payments"},
+				ServiceAccounts: []string{"billing"},
+				Policies:        []string{"payments-write"},
+			},
+			{
+				Namespaces: []string{"default"},
+				Selector:   map[string]string{"app": "web", "tier": "frontend"},
+				Policies:   []string{"web"},
+				Roles:      []string{"*"},
+			},
+		},
+	}
+	pod := func(namespace, serviceAccount string, labels map[string]string) *Pod {
+		p := &Pod{}
+		p.Metadata.Namespace = namespace
+		p.Metadata.Labels = labels
+		p.Spec.ServiceAccountName = serviceAccount
+		return p
+	}
+	web := map[string]string{"app": "web", "tier": "frontend"}
+
+	tests := []struct {
+		name           string
+		pod            *Pod
+		policies       []string
+		role           string
+		wantDisallowed []string
+		wantRole       bool
+	}{
+		{
+			name:     "namespace ceiling",
+			pod:      pod("payments", "default", nil),
+			policies: []string{"payments-read"},
+			role:     "payments",
+			wantRole: true,
+		},
+		{
+			name:           "policy of another service account",
+			pod:            pod("payments", "default", nil),
+			policies:       []string{"payments-read", "payments-write"},
+			wantDisallowed: []string{"payments-write"},
+		},
+		{
+			name:     "union of matching ceilings",
+			pod:      pod("payments", "billing", nil),
+			policies: []string{"payments-read", "payments-write"},
+		},
+		{
+			name:           "other namespace",
+			pod:            pod("default", "billing", nil),
+			policies:       []string{"payments-read", "root"},
+			role:           "payments",
+			wantDisallowed: []string{"payments-read", "root"},
+		},
+		{
+			name:     "selector",
+			pod:      pod("default", "default", web),
+			policies: []string{"web"},
+			role:     "anything",
+			wantRole: true,
+		},
+		{
+			name:           "selector in another namespace",
+			pod:            pod("payments", "default", web),
+			policies:       []string{"web"},
+			role:           "anything",
+			wantDisallowed: []string{"web"},
+		},
+		{
+			name:           "selector needs every label",
+			pod:            pod("default", "default", map[string]string{"app": "web"}),
+			policies:       []string{"web"},
+			role:           "anything",
+			wantDisallowed: []string{"web"},
+		},
+		{
+			name:     "no policies requested",
+			pod:      pod("default", "default", nil),
+			role:     "payments",
+			wantRole: false,
+		},
+	}
+	for _, tt := range tests {
+		if got := config.disallowedPolicies(tt.pod, tt.policies); !reflect.DeepEqual(got, tt.wantDisallowed) {
+			t.Errorf("%s: disallowedPolicies() = %v, want %v", tt.name, got, tt.wantDisallowed)
+		}
+		if tt.role == "" {
+			continue
+		}
+		if got := config.roleAllowed(tt.pod, tt.role); got != tt.wantRole {
+			t.Errorf("%s: roleAllowed(%q) = %v, want %v", tt.name, tt.role, got, tt.wantRole)
+		}
+	}
+
+	// Without ceilings nothing is restricted.
+	open := &Config{}
+	p := pod("default", "default", nil)
+	if got := open.disallowedPolicies(p, []string{"root"}); got != nil {
+		t.Errorf("disallowedPolicies() without ceilings = %v, want nil", got)
+	}
+	if !open.roleAllowed(p, "admin") {
+		t.Error("roleAllowed() without ceilings = false, want true")
+	}
+}
+
+func TestLoadConfigSelectorCeilings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	tests := []struct {
+		name    string
+		ceiling string
+		wantErr bool
+	}{
+		{name: "namespace", ceiling: `{namespaces: ["web"], selector: {app: web}, policies: ["web"]}`},
+		{name: "service account", ceiling: `{serviceAccounts: ["web"], selector: {app: web}, policies: ["web"]}`},
+		{name: "no selector", ceiling: `{namespaces: ["*"], policies: ["default"]}`},
+		{name: "selector only", ceiling: `{selector: {app: web}, policies: ["web"]}`, wantErr: true},
+		{name: "wildcard namespace", ceiling: `{namespaces: ["*"], selector: {app: web}, roles: ["*"]}`, wantErr: true},
+		{name: "wildcard among namespaces", ceiling: `{namespaces: ["web", "*"], selector: {app: web}, policies: ["web"]}`, wantErr: true},
+		{name: "wildcards", ceiling: `{namespaces: ["*"], serviceAccounts: ["*"], selector: {app: web}, policies: ["web"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte("policyCeilings:\n  - "+tt.ceiling+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "selector") {
+				t.Errorf("%s: loadConfig() error = %v, want a selector error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadConfig() returned error: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+const eventComponent = "vault-controller"
+
+// Event types.
+const (
+	eventNormal  = "Normal"
+	eventWarning = "Warning"
+)
+
+// Event reasons reported against pods.
+const (
+	reasonTokenIssued          = "TokenIssued"
+	reasonTokenPushed          = "TokenPushed"
+	reasonTokenPushFailed      = "TokenPushFailed"
+	reasonTokenRejected        = "TokenRejected"
+	reasonTokenIntercepted     = "TokenIntercepted"
+	reasonTokenRevoked         = "TokenRevoked"
+	reasonTokenCreateFailed    = "TokenCreateFailed"
+	reasonSecretReadFailed     = "SecretReadFailed"
+	reasonPolicyMissing        = "PolicyMissing"
+	reasonPolicyDenied         = "PolicyDenied"
+	reasonInvalidTokenSettings = "InvalidTokenSettings"
+	reasonPodIPMissing         = "PodIPMissing"
+	reasonTokenRequestDenied   = "TokenRequestDenied"
+)
+
+const (
+	// eventQueueSize bounds the events waiting to be sent. Events recorded
+	// while the queue is full are dropped.
+	eventQueueSize = 1000
+
+	// eventAggregationWindow is how long an Event is updated, rather than
+	// a new one posted, when the same reason is recorded for the pod again.
+	eventAggregationWindow = 10 * time.Minute
+
+	// eventCacheSize bounds the Events remembered for aggregation.
+	eventCacheSize = 4096
+)
+
+// eventRateLimit bounds the events recorded per pod, so a pod retrying a
+// failing request cannot flood the API server. The bucket refills within
+// limiterIdleTimeout.
+var eventRateLimit = TokenBucket{Requests: 1, Per: "1m", Burst: 10}
+
+// events sends the events recorded by recordEvent. Run must be started for
+// them to reach the API server.
+var events = newEventRecorder()
+
+// eventRecorder sends events from a single worker. Repeats of a reason for
+// the same pod are folded into one Event by bumping its count, the way
+// kubectl shows them.
+type eventRecorder struct {
+	queue   chan *Event
+	limiter *keyedLimiter
+
+	// recent is only used by the worker.
+	recent map[eventKey]*recentEvent
+}
+
+type eventKey struct {
+	uid    string
+	reason string
+}
+
+type recentEvent struct {
+	name     string
+	count    int
+	lastSeen time.Time
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{
+		queue:   make(chan *Event, eventQueueSize),
+		limiter: newKeyedLimiter(eventRateLimit),
+		recent:  make(map[eventKey]*recentEvent),
+	}
+}
+
+// recordEvent posts a Kubernetes Event against the pod so the outcome of a
+// token request shows up in kubectl describe pod. Events are posted in the
+// background and failures are only logged.
+func recordEvent(pod *Pod, eventType, reason, message string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	host, _ := os.Hostname()
+	event := &Event{
+		APIVersion: "v1",
+		Kind:       "Event",
+		Metadata: Metadata{
+			GenerateName: pod.Metadata.Name + ".",
+			Namespace:    pod.Metadata.Namespace,
+		},
+		InvolvedObject: ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "Pod",
+			Namespace:       pod.Metadata.Namespace,
+			Name:            pod.Metadata.Name,
+			UID:             pod.Metadata.Uid,
+			ResourceVersion: pod.Metadata.ResourceVersion,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Count:               1,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Source:              EventSource{Component: eventComponent, Host: host},
+		ReportingController: eventComponent,
+		ReportingInstance:   host,
+	}
+	events.record(event)
+}
+
+// record queues the event without blocking. Events over the pod's rate
+// limit, or that find the queue full, are dropped.
+func (r *eventRecorder) record(event *Event) {
+	key := event.InvolvedObject.UID
+	if key == "" {
+		key = podKey(event.InvolvedObject.Namespace, event.InvolvedObject.Name)
+	}
+	if reservation, _ := r.limiter.Reserve(key, time.Now()); reservation == nil {
+		return
+	}
+	select {
+	case r.queue <- event:
+	default:
+		log.Printf("event queue full; dropping %s event for pod %s", event.Reason, podKey(event.InvolvedObject.Namespace, event.InvolvedObject.Name))
+	}
+}
+
+// Run sends queued events until done is closed.
+func (r *eventRecorder) Run(done <-chan struct{}) {
+	for {
+		select {
+		case event := <-r.queue:
+			if err := r.send(event, time.Now()); err != nil {
+				log.Printf("error recording %s event for pod %s: %v", event.Reason, podKey(event.InvolvedObject.Namespace, event.InvolvedObject.Name), err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// send updates the Event recently posted for the same pod and reason, or
+// posts a new one.
+func (r *eventRecorder) send(event *Event, now time.Time) error {
+	collection := fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(event.Metadata.Namespace))
+	key := eventKey{uid: event.InvolvedObject.UID, reason: event.Reason}
+
+	if recent, ok := r.recent[key]; ok && now.Sub(recent.lastSeen) < eventAggregationWindow {
+		patch := map[string]interface{}{
+			"count":         recent.count + 1,
+			"message":       event.Message,
+			"lastTimestamp": event.LastTimestamp,
+		}
+		err := kubeClient.mergePatch(collection+"/"+url.PathEscape(recent.name), patch, nil)
+		if err == nil {
+			recent.count++
+			recent.lastSeen = now
+			return nil
+		}
+		// The API server may have garbage collected the Event already.
+		if !isNotFound(err) {
+			return err
+		}
+		delete(r.recent, key)
+	}
+
+	var created Event
+	if err := kubeClient.do("POST", collection, event, &created); err != nil {
+		return err
+	}
+	if key.uid == "" {
+		return nil
+	}
+	if len(r.recent) >= eventCacheSize {
+		for k, recent := range r.recent {
+			if now.Sub(recent.lastSeen) >= eventAggregationWindow {
+				delete(r.recent, k)
+			}
+		}
+	}
+	if len(r.recent) < eventCacheSize {
+		r.recent[key] = &recentEvent{name: created.Metadata.Name, count: 1, lastSeen: now}
+	}
+	return nil
+}
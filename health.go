@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// readyTimeout bounds the time taken by all readiness checks together.
+const readyTimeout = 5 * time.Second
+
+// healthCheck is one readiness check.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a check as reported by /readyz.
+type checkResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type readyResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// healthzHandler reports that the controller is running. It does not look
+// at Vault or the Kubernetes API, so an outage of either does not get the
+// controller restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// readyzHandler runs the readiness checks and reports each of them. The
+// controller is ready when all checks pass.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := runHealthChecks(r.Context(), readinessChecks())
+	code := http.StatusOK
+	if resp.Status != "ready" {
+		code = http.StatusServiceUnavailable
+		for _, c := range resp.Checks {
+			if c.Error != "" {
+				log.Printf("readiness check %s failed: %s", c.Name, c.Error)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readinessChecks returns the checks of every Vault backend and of the
+// Kubernetes API.
+func readinessChecks() []healthCheck {
+	var checks []healthCheck
+	names := make([]string, 0, len(vaults.backends))
+	for name := range vaults.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := vaults.backends[name]
+		checks = append(checks,
+			healthCheck{"vault:" + name + ":health", b.checkHealth},
+			healthCheck{"vault:" + name + ":token", b.checkToken},
+		)
+	}
+	checks = append(checks, healthCheck{"kubernetes", kubeClient.checkHealth})
+	return checks
+}
+
+// runHealthChecks runs the checks concurrently. Checks still running after
+// readyTimeout fail.
+func runHealthChecks(ctx context.Context, checks []healthCheck) readyResponse {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	type indexedResult struct {
+		i      int
+		result checkResult
+	}
+	results := make([]checkResult, len(checks))
+	done := make(chan indexedResult, len(checks))
+	for i, c := range checks {
+		results[i] = checkResult{Name: c.name, Status: "fail", Error: "timed out"}
+		go func(i int, c healthCheck) {
+			start := time.Now()
+			err := c.check(ctx)
+			result := checkResult{Name: c.name, Status: "ok"}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+			result.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+			done <- indexedResult{i, result}
+		}(i, c)
+	}
+
+wait:
+	for n := 0; n < len(checks); n++ {
+		select {
+		case r := <-done:
+			results[r.i] = r.result
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	resp := readyResponse{Status: "ready", Checks: results}
+	for _, r := range results {
+		if r.Status != "ok" {
+			resp.Status = "not ready"
+		}
+	}
+	return resp
+}
+
+// checkHealth checks that Vault is initialized, unsealed and active. A
+// standby forwards requests to the active node, but one that cannot reach
+// it fails them, so standbys are not ready.
+func (b *vaultBackend) checkHealth(ctx context.Context) error {
+	health, err := b.client.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !health.Initialized:
+		return errors.New("vault is not initialized")
+	case health.Sealed:
+		return errors.New("vault is sealed")
+	case health.Standby:
+		return errors.New("vault is in standby")
+	}
+	return nil
+}
+
+// checkToken checks that the controller's own token is valid.
+func (b *vaultBackend) checkToken(ctx context.Context) error {
+	_, err := b.client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("controller token lookup failed: %v", err)
+	}
+	return nil
+}
+
+// checkHealth checks that the Kubernetes API server is reachable and
+// accepts the controller's credentials.
+func (c *kubernetesClient) checkHealth(ctx context.Context) error {
+	return c.doWithContext(ctx, "GET", "/version", nil, nil)
+}
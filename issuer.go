@@ -0,0 +1,271 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// tokenGrant is what a pod is entitled to, combined from its annotations
+// and the VaultPolicyBindings that select it.
+type tokenGrant struct {
+	Policies       []string
+	Role           string
+	TTL            string
+	Period         string
+	ExplicitMaxTTL string
+	NumUses        string
+	Renewable      string
+	EntityAlias    string
+	WrapTTL        string
+	Secrets        []string
+	Bindings       []string
+}
+
+// resolveGrant combines the pod annotations with the matching bindings.
+// Policies are the union of both. Annotations take precedence for the
+// other settings, then the first binding by name that sets one. Values are
+// validated by Config.tokenShape.
+func resolveGrant(pod *Pod) *tokenGrant {
+	g := &tokenGrant{}
+	seen := make(map[string]bool)
+	addPolicies := func(policies []string) {
+		for _, p := range policies {
+			p = strings.TrimSpace(p)
+			if p != "" && !seen[p] {
+				seen[p] = true
+				g.Policies = append(g.Policies, p)
+			}
+		}
+	}
+
+	annotations := pod.Metadata.Annotations
+	if policies := annotations["vaultproject.io/policies"]; policies != "" {
+		addPolicies(strings.Split(policies, ","))
+	}
+	g.Role = annotations["vaultproject.io/role"]
+	g.TTL = annotations["vaultproject.io/ttl"]
+	g.Period = annotations["vaultproject.io/period"]
+	g.ExplicitMaxTTL = annotations["vaultproject.io/explicit-max-ttl"]
+	g.NumUses = annotations["vaultproject.io/num-uses"]
+	g.Renewable = annotations["vaultproject.io/renewable"]
+	g.EntityAlias = annotations["vaultproject.io/entity-alias"]
+	g.WrapTTL = annotations["vaultproject.io/wrap-ttl"]
+	g.Secrets = parseSecretPaths(annotations["vaultproject.io/secrets"])
+
+	for _, b := range policyBindings.Match(pod) {
+		g.Bindings = append(g.Bindings, b.Metadata.Name)
+		addPolicies(b.Spec.Policies)
+		if g.Role == "" {
+			g.Role = b.Spec.Role
+		}
+		if g.TTL == "" {
+			g.TTL = b.Spec.TTL
+		}
+		if g.Period == "" {
+			g.Period = b.Spec.Period
+		}
+		if g.WrapTTL == "" {
+			g.WrapTTL = b.Spec.WrapTTL
+		}
+	}
+	return g
+}
+
+// empty reports whether the grant names neither policies nor a role.
+func (g *tokenGrant) empty() bool {
+	return len(g.Policies) == 0 && g.Role == ""
+}
+
+// wrappedToken is the payload pushed to vault-init: the wrapping token, the
+// secrets requested by the pod, and the address and namespace of the Vault
+// they must be unwrapped against.
+type wrappedToken struct {
+	*api.SecretWrapInfo
+	VaultAddr      string          `json:"vault_addr,omitempty"`
+	VaultNamespace string          `json:"vault_namespace,omitempty"`
+	Secrets        []wrappedSecret `json:"secrets,omitempty"`
+
+	vault           *vaultBackend
+	secretsAccessor string
+}
+
+// accessors returns the accessors of the tokens issued for the payload.
+func (t *wrappedToken) accessors() []string {
+	accessors := []string{t.WrappedAccessor}
+	if t.secretsAccessor != "" {
+		accessors = append(accessors, t.secretsAccessor)
+	}
+	return accessors
+}
+
+// revoke revokes every token issued for the payload.
+func (t *wrappedToken) revoke() {
+	for _, accessor := range t.accessors() {
+		revoker.Revoke(accessor)
+	}
+}
+
+// issueToken creates a wrapped token for the pod based on its annotations
+// and policy bindings and records it in the ledger and the audit entry. The
+// returned status code is meant to be returned to the caller when err is
+// not nil.
+func issueToken(pod *Pod, entry *auditEntry) (*wrappedToken, int, error) {
+	name := pod.Metadata.Name
+
+	vault, err := vaults.Get(pod.Metadata.Annotations["vaultproject.io/vault"])
+	if err != nil {
+		recordEvent(pod, eventWarning, reasonInvalidTokenSettings, fmt.Sprintf("Invalid token settings: %s", err))
+		return nil, 400, fmt.Errorf("error %s (%s)", err, name)
+	}
+
+	grant := resolveGrant(pod)
+	entry.RequestedPolicies = grant.Policies
+	entry.Role = grant.Role
+	entry.RequestedTTL = grant.TTL
+	if grant.empty() {
+		recordEvent(pod, eventWarning, reasonPolicyMissing, "The vaultproject.io/policies and vaultproject.io/role annotations are missing or empty and no VaultPolicyBinding selects the pod")
+		return nil, 500, fmt.Errorf("error no policies or role from pod annotations or a VaultPolicyBinding for pod (%s)", name)
+	}
+	policies := strings.Join(grant.Policies, ",")
+
+	if disallowed := controllerConfig.disallowedPolicies(pod, grant.Policies); len(disallowed) > 0 {
+		msg := fmt.Sprintf("policies not allowed for namespace %s and service account %s: %s",
+			pod.Metadata.Namespace, pod.Spec.ServiceAccountName, strings.Join(disallowed, ","))
+		recordEvent(pod, eventWarning, reasonPolicyDenied, "Token request denied: "+msg)
+		return nil, 403, fmt.Errorf("error %s (%s)", msg, name)
+	}
+	if grant.Role != "" && !controllerConfig.roleAllowed(pod, grant.Role) {
+		msg := fmt.Sprintf("token role %s not allowed for namespace %s and service account %s",
+			grant.Role, pod.Metadata.Namespace, pod.Spec.ServiceAccountName)
+		recordEvent(pod, eventWarning, reasonPolicyDenied, "Token request denied: "+msg)
+		return nil, 403, fmt.Errorf("error %s (%s)", msg, name)
+	}
+
+	if grant.WrapTTL == "" {
+		grant.WrapTTL = vault.wrapTTL
+	}
+	shape, err := controllerConfig.tokenShape(grant)
+	if err != nil {
+		recordEvent(pod, eventWarning, reasonInvalidTokenSettings, fmt.Sprintf("Invalid token settings: %s", err))
+		return nil, 400, fmt.Errorf("error %s (%s)", err, name)
+	}
+	entry.TTL = shape.TTL.String()
+	entry.WrapTTL = shape.WrapTTL.String()
+	if err := validateSecretPaths(grant.Secrets); err != nil {
+		recordEvent(pod, eventWarning, reasonInvalidTokenSettings, fmt.Sprintf("Invalid token settings: %s", err))
+		return nil, 400, fmt.Errorf("error %s (%s)", err, name)
+	}
+
+	tcr := &api.TokenCreateRequest{
+		Policies:       grant.Policies,
+		Metadata:       tokenMetadata(pod),
+		DisplayName:    pod.Metadata.Name,
+		Period:         vaultDuration(shape.Period),
+		TTL:            vaultDuration(shape.TTL),
+		ExplicitMaxTTL: vaultDuration(shape.ExplicitMaxTTL),
+		NumUses:        shape.NumUses,
+		Renewable:      shape.Renewable,
+		EntityAlias:    shape.EntityAlias,
+	}
+	if !vaultCreates.Acquire(vaultCreateWait) {
+		return nil, 503, &retryAfterError{
+			err:   fmt.Errorf("too many Vault token creates in progress; rejecting token request for pod (%s)", name),
+			after: busyRetryAfter,
+		}
+	}
+	defer vaultCreates.Release()
+
+	vaultNamespace := controllerConfig.vaultNamespace(pod.Metadata.Namespace)
+	// Orphan status is part of the role definition when a role is used.
+	if grant.Role == "" {
+		tcr.NoParent = true
+	} else if err := vault.checkOrphanRole(vaultNamespace, grant.Role); err != nil {
+		log.Printf("error creating wrapped token for pod (%s): %s", name, err)
+		recordEvent(pod, eventWarning, reasonTokenCreateFailed, fmt.Sprintf("Error creating Vault token: %s", err))
+		return nil, 500, fmt.Errorf("error creating wrapped token for pod (%s)", name)
+	}
+	namespaceLabel := metricsNamespaces.label(pod.Metadata.Namespace)
+	createStart := time.Now()
+	secret, err := vault.createWrappedToken(vaultNamespace, tcr, grant.Role, vaultDuration(shape.WrapTTL))
+	observeSince(vaultCreateDuration.WithLabelValues(namespaceLabel, vault.name), createStart)
+	if err != nil {
+		vaultCreateErrors.WithLabelValues(namespaceLabel, vault.name).Inc()
+		log.Printf("error creating wrapped token for pod (%s): %s", name, err)
+		recordEvent(pod, eventWarning, reasonTokenCreateFailed, fmt.Sprintf("Error creating Vault token: %s", err))
+		return nil, 500, fmt.Errorf("error creating wrapped token for pod (%s)", name)
+	}
+	if secret.WrapInfo == nil {
+		return nil, 500, fmt.Errorf("error parsing wrapped token for pod (%s)", name)
+	}
+
+	issueTime := time.Now().UTC()
+	accessor := secret.WrapInfo.WrappedAccessor
+	entry.Policies = tcr.Policies
+	entry.Accessor = accessor
+	entry.WrappingAccessor = secret.WrapInfo.Accessor
+	expiry := wrapExpiry(secret.WrapInfo)
+	err = ledger.Put(&IssuanceRecord{
+		PodUID:    pod.Metadata.Uid,
+		Namespace: pod.Metadata.Namespace,
+		Name:      pod.Metadata.Name,
+		Accessor:  accessor,
+		Policies:  tcr.Policies,
+		Role:      grant.Role,
+		TTL:       shape.TTL.String(),
+		IssueTime: issueTime,
+		Delivery:  deliveryPending,
+		Bindings:  grant.Bindings,
+		Vault:     vault.name,
+
+		VaultNamespace: vaultNamespace,
+
+		WrappingAccessor: secret.WrapInfo.Accessor,
+		WrapExpiry:       &expiry,
+	})
+	if err != nil {
+		// The token cannot be tracked, so it must not be handed out.
+		if err := vault.revokeAccessor(vaultNamespace, accessor); err != nil {
+			log.Printf("error revoking untracked token for pod (%s): %s", name, err)
+		}
+		recordEvent(pod, eventWarning, reasonTokenCreateFailed, "Error recording the Vault token in the issuance ledger")
+		return nil, 500, fmt.Errorf("error recording token for pod (%s): %s", name, err)
+	}
+
+	token := &wrappedToken{
+		SecretWrapInfo: secret.WrapInfo,
+		VaultAddr:      vault.address,
+		VaultNamespace: vaultNamespace,
+		vault:          vault,
+	}
+	if len(grant.Secrets) > 0 {
+		secrets, secretsAccessor, code, err := issueSecrets(pod, vault, vaultNamespace, tcr, grant.Role, grant.Secrets, vaultDuration(shape.WrapTTL), expiry)
+		if err != nil {
+			revoker.Revoke(accessor)
+			return nil, code, err
+		}
+		token.Secrets = secrets
+		token.secretsAccessor = secretsAccessor
+	}
+	policyBindings.RecordIssuance(pod.Metadata.Namespace, grant.Bindings, issueTime)
+	if grant.Role != "" {
+		recordEvent(pod, eventNormal, reasonTokenIssued, fmt.Sprintf("Issued Vault token through role %s with policies %s", grant.Role, policies))
+	} else {
+		recordEvent(pod, eventNormal, reasonTokenIssued, fmt.Sprintf("Issued Vault token with policies %s", policies))
+	}
+	return token, 200, nil
+}
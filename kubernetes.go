@@ -11,20 +11,225 @@
 
 package main
 
+import "encoding/json"
+
 type Pod struct {
 	Kind     string   `json:"kind,omitempty"`
 	Metadata Metadata `json:"metadata"`
+	Spec     PodSpec  `json:"spec"`
 	Status   Status   `json:"status"`
 }
 
 type Metadata struct {
-	Name        string            `json:"name"`
-	Namespace   string            `json:"namespace"`
-	Annotations map[string]string `json:"annotations"`
-	Uid         string            `json:"uid"`
+	Name            string            `json:"name,omitempty"`
+	GenerateName    string            `json:"generateName,omitempty"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	Uid             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+type OwnerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Uid        string `json:"uid"`
+	Controller *bool  `json:"controller,omitempty"`
+}
+
+// ObjectList is any Kubernetes list; the items are decoded by the caller.
+type ObjectList struct {
+	Metadata ListMetadata      `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type ListMetadata struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type PodSpec struct {
+	ServiceAccountName string `json:"serviceAccountName"`
+	NodeName           string `json:"nodeName"`
 }
 
 type Status struct {
+	Phase  string `json:"phase"`
 	PodIP  string `json:"podIP"`
 	HostIP string `json:"hostIP"`
 }
+
+type TokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       TokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status,omitempty"`
+}
+
+type TokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type TokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          UserInfo `json:"user"`
+	Audiences     []string `json:"audiences,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type UserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra"`
+}
+
+type APIStatus struct {
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+// LedgerObject holds the fields of a Secret or ConfigMap used by the
+// Kubernetes ledger backend. Secret data is base64 encoded.
+type LedgerObject struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   Metadata          `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string]string `json:"data"`
+}
+
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      GroupVersionKind `json:"kind"`
+	Namespace string           `json:"namespace"`
+	Operation string           `json:"operation"`
+	Object    json.RawMessage  `json:"object"`
+}
+
+type AdmissionResponse struct {
+	UID       string  `json:"uid"`
+	Allowed   bool    `json:"allowed"`
+	Patch     []byte  `json:"patch,omitempty"`
+	PatchType *string `json:"patchType,omitempty"`
+}
+
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// AdmissionPod holds the parts of a pod spec the admission webhook needs
+// to build its patch.
+type AdmissionPod struct {
+	Metadata Metadata `json:"metadata"`
+	Spec     struct {
+		ServiceAccountName string      `json:"serviceAccountName"`
+		InitContainers     []Container `json:"initContainers"`
+		Containers         []Container `json:"containers"`
+		Volumes            []struct {
+			Name string `json:"name"`
+		} `json:"volumes"`
+	} `json:"spec"`
+}
+
+type Container struct {
+	Name         string        `json:"name"`
+	VolumeMounts []VolumeMount `json:"volumeMounts"`
+}
+
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type Event struct {
+	APIVersion          string          `json:"apiVersion"`
+	Kind                string          `json:"kind"`
+	Metadata            Metadata        `json:"metadata"`
+	InvolvedObject      ObjectReference `json:"involvedObject"`
+	Reason              string          `json:"reason"`
+	Message             string          `json:"message"`
+	Type                string          `json:"type"`
+	Count               int             `json:"count"`
+	FirstTimestamp      string          `json:"firstTimestamp"`
+	LastTimestamp       string          `json:"lastTimestamp"`
+	Source              EventSource     `json:"source"`
+	ReportingController string          `json:"reportingComponent"`
+	ReportingInstance   string          `json:"reportingInstance"`
+}
+
+type ObjectReference struct {
+	APIVersion      string `json:"apiVersion,omitempty"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type EventSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+type Lease struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Metadata   Metadata  `json:"metadata"`
+	Spec       LeaseSpec `json:"spec"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// VaultPolicyBinding grants Vault policies to the pods it selects.
+type VaultPolicyBinding struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   Metadata                 `json:"metadata"`
+	Spec       VaultPolicyBindingSpec   `json:"spec"`
+	Status     VaultPolicyBindingStatus `json:"status"`
+}
+
+type VaultPolicyBindingSpec struct {
+	PodSelector         *LabelSelector `json:"podSelector,omitempty"`
+	ServiceAccountNames []string       `json:"serviceAccountNames,omitempty"`
+	Policies            []string       `json:"policies,omitempty"`
+	Role                string         `json:"role,omitempty"`
+	TTL                 string         `json:"ttl,omitempty"`
+	Period              string         `json:"period,omitempty"`
+	WrapTTL             string         `json:"wrapTTL,omitempty"`
+}
+
+type VaultPolicyBindingStatus struct {
+	MatchedPods      int    `json:"matchedPods"`
+	LastIssuanceTime string `json:"lastIssuanceTime,omitempty"`
+}
+
+type LabelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
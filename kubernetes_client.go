@@ -0,0 +1,420 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	serviceAccountDir       = "/var/run/secrets/kubernetes.io/serviceaccount"
+	serviceAccountTokenFile = serviceAccountDir + "/token"
+	serviceAccountCAFile    = serviceAccountDir + "/ca.crt"
+
+	// kubernetesRequestTimeout bounds every request but watches, so a hung
+	// API server cannot hold up token requests or the reflectors.
+	kubernetesRequestTimeout = 30 * time.Second
+)
+
+// kubernetesClient is a minimal Kubernetes API client. It authenticates
+// with a bearer token or client certificate taken from the pod's service
+// account or a kubeconfig file. Requests are sent with client, which times
+// out; watches are streamed with streamClient, which shares its transport
+// but does not.
+type kubernetesClient struct {
+	host         string
+	token        string
+	tokenFile    string
+	client       *http.Client
+	streamClient *http.Client
+}
+
+// apiError is returned when the Kubernetes API responds with a non 2xx
+// status code.
+type apiError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("kubernetes api: %s", e.Message)
+	}
+	return fmt.Sprintf("kubernetes api: %d %s", e.Code, http.StatusText(e.Code))
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusConflict && e.Reason != "AlreadyExists"
+}
+
+func isAlreadyExists(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusConflict && e.Reason == "AlreadyExists"
+}
+
+// newKubernetesClient returns a client configured from the kubeconfig file
+// when one is given, otherwise from the in-cluster service account.
+func newKubernetesClient(kubeconfig string) (*kubernetesClient, error) {
+	if kubeconfig != "" {
+		return kubernetesClientFromKubeconfig(kubeconfig)
+	}
+	return inClusterKubernetesClient()
+}
+
+func inClusterKubernetesClient() (*kubernetesClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(ca); !ok {
+		return nil, fmt.Errorf("no certificates found in %s", serviceAccountCAFile)
+	}
+	if _, err := os.Stat(serviceAccountTokenFile); err != nil {
+		return nil, fmt.Errorf("could not read service account token: %v", err)
+	}
+
+	c := &kubernetesClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountTokenFile,
+	}
+	c.setTransport(&tls.Config{RootCAs: pool})
+	return c, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string              `json:"current-context"`
+	Clusters       []kubeconfigCluster `json:"clusters"`
+	Contexts       []kubeconfigContext `json:"contexts"`
+	Users          []kubeconfigUser    `json:"users"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `json:"name"`
+	Cluster struct {
+		Server                   string `json:"server"`
+		CertificateAuthority     string `json:"certificate-authority"`
+		CertificateAuthorityData []byte `json:"certificate-authority-data"`
+		InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+	} `json:"cluster"`
+}
+
+type kubeconfigContext struct {
+	Name    string `json:"name"`
+	Context struct {
+		Cluster string `json:"cluster"`
+		User    string `json:"user"`
+	} `json:"context"`
+}
+
+type kubeconfigUser struct {
+	Name string `json:"name"`
+	User struct {
+		Token                 string `json:"token"`
+		TokenFile             string `json:"tokenFile"`
+		ClientCertificate     string `json:"client-certificate"`
+		ClientCertificateData []byte `json:"client-certificate-data"`
+		ClientKey             string `json:"client-key"`
+		ClientKeyData         []byte `json:"client-key-data"`
+	} `json:"user"`
+}
+
+func kubernetesClientFromKubeconfig(path string) (*kubernetesClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read kubeconfig: %v", err)
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse kubeconfig: %v", err)
+	}
+
+	var (
+		context *kubeconfigContext
+		cluster *kubeconfigCluster
+		user    *kubeconfigUser
+	)
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == config.CurrentContext {
+			context = &config.Contexts[i]
+		}
+	}
+	if context == nil {
+		return nil, fmt.Errorf("kubeconfig: current context %q not found", config.CurrentContext)
+	}
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == context.Context.Cluster {
+			cluster = &config.Clusters[i]
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("kubeconfig: cluster %q not found", context.Context.Cluster)
+	}
+	for i := range config.Users {
+		if config.Users[i].Name == context.Context.User {
+			user = &config.Users[i]
+		}
+	}
+	if user == nil {
+		return nil, fmt.Errorf("kubeconfig: user %q not found", context.Context.User)
+	}
+
+	// Relative paths in a kubeconfig are relative to the file itself.
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.Cluster.InsecureSkipTLSVerify}
+	ca := cluster.Cluster.CertificateAuthorityData
+	if ca == nil && cluster.Cluster.CertificateAuthority != "" {
+		ca, err = ioutil.ReadFile(resolve(cluster.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: could not read certificate authority: %v", err)
+		}
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(ca); !ok {
+			return nil, errors.New("kubeconfig: no certificates found in certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certData, keyData := user.User.ClientCertificateData, user.User.ClientKeyData
+	if certData == nil && user.User.ClientCertificate != "" {
+		certData, err = ioutil.ReadFile(resolve(user.User.ClientCertificate))
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: could not read client certificate: %v", err)
+		}
+	}
+	if keyData == nil && user.User.ClientKey != "" {
+		keyData, err = ioutil.ReadFile(resolve(user.User.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: could not read client key: %v", err)
+		}
+	}
+	if certData != nil && keyData != nil {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	c := &kubernetesClient{
+		host:      strings.TrimSuffix(cluster.Cluster.Server, "/"),
+		token:     user.User.Token,
+		tokenFile: resolve(user.User.TokenFile),
+	}
+	c.setTransport(tlsConfig)
+	return c, nil
+}
+
+// setTransport sets up the request and stream clients over one transport.
+func (c *kubernetesClient) setTransport(tlsConfig *tls.Config) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 10,
+	}
+	c.client = &http.Client{Transport: transport, Timeout: kubernetesRequestTimeout}
+	c.streamClient = &http.Client{Transport: transport}
+}
+
+// bearerToken returns the token used to authenticate with the API server.
+func (c *kubernetesClient) bearerToken() (string, error) {
+	if c.tokenFile == "" {
+		return c.token, nil
+	}
+	return readServiceAccountToken(c.tokenFile)
+}
+
+// readServiceAccountToken reads a service account token file. Projected
+// service account tokens are rotated by the kubelet, so callers read the
+// file every time they need the token rather than keeping it.
+func readServiceAccountToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read service account token: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// errWatchExpired is returned when the resource version a watch was started
+// from is too old and the caller must relist.
+var errWatchExpired = errors.New("watch expired")
+
+// do sends a request to the API server and decodes a successful response
+// into out. Non 2xx responses are returned as an *apiError.
+func (c *kubernetesClient) do(method, path string, in, out interface{}) error {
+	return c.doWithContext(context.Background(), method, path, in, out)
+}
+
+// doWithContext is do with a context that can cancel the request before the
+// client's own timeout.
+func (c *kubernetesClient) doWithContext(ctx context.Context, method, path string, in, out interface{}) error {
+	return c.sendWithContext(ctx, method, path, "application/json", in, out)
+}
+
+// mergePatch applies a JSON merge patch to the object at path.
+func (c *kubernetesClient) mergePatch(path string, patch, out interface{}) error {
+	return c.sendWithContext(context.Background(), "PATCH", path, "application/merge-patch+json", patch, out)
+}
+
+func (c *kubernetesClient) sendWithContext(ctx context.Context, method, path, contentType string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(in); err != nil {
+			return fmt.Errorf("error encoding request body: %v", err)
+		}
+		body = &buf
+	}
+
+	request, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("error parsing response body: %v", err)
+	}
+	return nil
+}
+
+// stream sends a GET request and returns the response body unread, which is
+// used for watches.
+func (c *kubernetesClient) stream(path string) (io.ReadCloser, error) {
+	request, err := c.newRequest(context.Background(), "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.streamClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, newAPIError(resp.StatusCode, data)
+	}
+	return resp.Body, nil
+}
+
+func (c *kubernetesClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	token, err := c.bearerToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request, nil
+}
+
+func newAPIError(code int, data []byte) *apiError {
+	e := &apiError{Code: code}
+	var status APIStatus
+	if err := json.Unmarshal(data, &status); err == nil && status.Kind == "Status" {
+		e.Reason = status.Reason
+		e.Message = status.Message
+	}
+	return e
+}
+
+func (c *kubernetesClient) getPod(namespace, name string) (*Pod, error) {
+	var pod Pod
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := c.do("GET", path, nil, &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+func (c *kubernetesClient) createTokenReview(tr *TokenReview) (*TokenReview, error) {
+	var result TokenReview
+	if err := c.do("POST", "/apis/authentication.k8s.io/v1/tokenreviews", tr, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// getOwnerReferences returns the owner references of the object at path.
+func (c *kubernetesClient) getOwnerReferences(path string) ([]OwnerReference, error) {
+	var object struct {
+		Metadata Metadata `json:"metadata"`
+	}
+	if err := c.do("GET", path, nil, &object); err != nil {
+		return nil, err
+	}
+	return object.Metadata.OwnerReferences, nil
+}
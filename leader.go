@@ -0,0 +1,192 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	leaseDuration    = 15 * time.Second
+	leaseRenewPeriod = 5 * time.Second
+
+	// Lease times use the Kubernetes MicroTime format.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// leaderElector elects a single controller replica through a Kubernetes
+// Lease. Token requests are served by every replica; only background work
+// such as revocation, reconciliation and push mode runs on the leader.
+type leaderElector struct {
+	client    *kubernetesClient
+	namespace string
+	name      string
+	identity  string
+
+	// onStartedLeading is called every time this replica becomes the
+	// leader.
+	onStartedLeading []func()
+
+	sync.RWMutex
+	leader       bool
+	observed     string
+	observedTime time.Time
+	lastRenew    time.Time
+}
+
+func newLeaderElector(client *kubernetesClient, namespace, name, identity string) *leaderElector {
+	return &leaderElector{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+	}
+}
+
+// IsLeader reports whether this replica currently holds the lease. A nil
+// elector means leader election is disabled and the replica always leads.
+func (le *leaderElector) IsLeader() bool {
+	if le == nil {
+		return true
+	}
+	le.RLock()
+	defer le.RUnlock()
+	return le.leader
+}
+
+// OnStartedLeading registers f to be called when this replica becomes the
+// leader. It must be called before Run.
+func (le *leaderElector) OnStartedLeading(f func()) {
+	if le == nil {
+		return
+	}
+	le.onStartedLeading = append(le.onStartedLeading, f)
+}
+
+// Run tries to acquire and then renew the lease until done is closed.
+func (le *leaderElector) Run(done <-chan struct{}) {
+	for {
+		if err := le.tryAcquireOrRenew(); err != nil {
+			log.Printf("leader election: %v", err)
+		}
+
+		// Step down before the lease can expire so two replicas never
+		// act as leader at the same time.
+		le.Lock()
+		if le.leader && time.Since(le.lastRenew) > leaseDuration-leaseRenewPeriod {
+			le.leader = false
+			log.Printf("leader election: failed to renew lease %s/%s; stepping down", le.namespace, le.name)
+		}
+		le.Unlock()
+
+		select {
+		case <-time.After(leaseRenewPeriod):
+		case <-done:
+			return
+		}
+	}
+}
+
+func (le *leaderElector) leasePath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", le.namespace, le.name)
+}
+
+func (le *leaderElector) tryAcquireOrRenew() error {
+	now := time.Now()
+	nowString := now.UTC().Format(microTimeFormat)
+	durationSeconds := int(leaseDuration / time.Second)
+
+	var lease Lease
+	err := le.client.do("GET", le.leasePath(), nil, &lease)
+	if isNotFound(err) {
+		lease = Lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   Metadata{Name: le.name, Namespace: le.namespace},
+			Spec: LeaseSpec{
+				HolderIdentity:       le.identity,
+				LeaseDurationSeconds: durationSeconds,
+				AcquireTime:          nowString,
+				RenewTime:            nowString,
+			},
+		}
+		path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", le.namespace)
+		if err := le.client.do("POST", path, &lease, nil); err != nil {
+			return fmt.Errorf("error creating lease: %v", err)
+		}
+		le.setLeader(now)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading lease: %v", err)
+	}
+
+	// Expiry is judged against the local time the current lease record was
+	// first seen, so clock skew between replicas does not matter.
+	record := lease.Spec.HolderIdentity + "/" + lease.Spec.RenewTime
+	le.Lock()
+	if record != le.observed {
+		le.observed = record
+		le.observedTime = now
+	}
+	observedTime := le.observedTime
+	le.Unlock()
+
+	holder := lease.Spec.HolderIdentity
+	duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	if holder != "" && holder != le.identity && now.Before(observedTime.Add(duration)) {
+		le.Lock()
+		if le.leader {
+			log.Printf("leader election: lease %s/%s is held by %s; stepping down", le.namespace, le.name, holder)
+		}
+		le.leader = false
+		le.Unlock()
+		return nil
+	}
+
+	if holder != le.identity {
+		lease.Spec.HolderIdentity = le.identity
+		lease.Spec.AcquireTime = nowString
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = durationSeconds
+	lease.Spec.RenewTime = nowString
+
+	// The resource version read above makes this update fail if another
+	// replica took the lease in the meantime.
+	if err := le.client.do("PUT", le.leasePath(), &lease, nil); err != nil {
+		if isConflict(err) {
+			return nil
+		}
+		return fmt.Errorf("error updating lease: %v", err)
+	}
+	le.setLeader(now)
+	return nil
+}
+
+func (le *leaderElector) setLeader(now time.Time) {
+	le.Lock()
+	started := !le.leader
+	le.leader = true
+	le.lastRenew = now
+	le.Unlock()
+
+	if started {
+		log.Printf("leader election: %s acquired lease %s/%s", le.identity, le.namespace, le.name)
+		for _, f := range le.onStartedLeading {
+			go f()
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseStore serves a single Lease with the optimistic concurrency of
+// the API server. Setting stale makes the next update conflict, as if
+// another replica had written the lease first.
+type fakeLeaseStore struct {
+	sync.Mutex
+	lease   *Lease
+	version int
+	stale   bool
+}
+
+func (s *fakeLeaseStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := func(code int, reason string) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(APIStatus{Kind: "Status", Reason: reason})
+	}
+	s.Lock()
+	defer s.Unlock()
+	var lease Lease
+	if r.Method == "POST" || r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+			status(400, "BadRequest")
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		if s.lease == nil {
+			status(404, "NotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(s.lease)
+	case "POST":
+		if s.lease != nil {
+			status(409, "AlreadyExists")
+			return
+		}
+		s.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(s.version)
+		s.lease = &lease
+		json.NewEncoder(w).Encode(&lease)
+	case "PUT":
+		if s.stale {
+			s.stale = false
+			s.version++
+			s.lease.Metadata.ResourceVersion = strconv.Itoa(s.version)
+		}
+		if lease.Metadata.ResourceVersion != s.lease.Metadata.ResourceVersion {
+			status(409, "Conflict")
+			return
+		}
+		s.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(s.version)
+		s.lease = &lease
+		json.NewEncoder(w).Encode(&lease)
+	}
+}
+
+func (s *fakeLeaseStore) holder() (string, int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.lease == nil {
+		return "", 0
+	}
+	return s.lease.Spec.HolderIdentity, s.lease.Spec.LeaseTransitions
+}
+
+func TestLeaderElection(t *testing.T) {
+	store := &fakeLeaseStore{}
+	_, done := fakeKubernetes(store)
+	defer done()
+
+	started := make(chan string, 10)
+	newElector := func(identity string) *leaderElector {
+		le := newLeaderElector(kubeClient, "vault-controller", "vault-controller", identity)
+		le.OnStartedLeading(func() { started <- identity })
+		return le
+	}
+	a, b := newElector("a"), newElector("b")
+
+	// expire makes the elector treat the lease it last saw as expired.
+	expire := func(le *leaderElector) {
+		le.Lock()
+		le.observedTime = time.Now().Add(-leaseDuration)
+		le.Unlock()
+	}
+
+	tests := []struct {
+		name       string
+		elector    *leaderElector
+		before     func()
+		wantLeader bool
+		wantHolder string
+		wantStart  bool
+		wantTrans  int
+	}{
+		{name: "a creates the lease", elector: a, wantLeader: true, wantHolder: "a", wantStart: true},
+		{name: "b finds it held", elector: b, wantHolder: "a"},
+		{name: "a renews", elector: a, wantLeader: true, wantHolder: "a"},
+		{name: "b races another writer", elector: b, before: func() {
+			b.tryAcquireOrRenew()
+			expire(b)
+			store.Lock()
+			store.stale = true
+			store.Unlock()
+		}, wantHolder: "a"},
+		{name: "b takes over the expired lease", elector: b, before: func() { expire(b) }, wantLeader: true, wantHolder: "b", wantStart: true, wantTrans: 1},
+		{name: "a steps down", elector: a, wantHolder: "b", wantTrans: 1},
+		{name: "b renews", elector: b, wantLeader: true, wantHolder: "b", wantTrans: 1},
+	}
+	for _, tt := range tests {
+		if tt.before != nil {
+			tt.before()
+		}
+		if err := tt.elector.tryAcquireOrRenew(); err != nil {
+			t.Errorf("%s: tryAcquireOrRenew() returned error: %v", tt.name, err)
+		}
+		if leader := tt.elector.IsLeader(); leader != tt.wantLeader {
+			t.Errorf("%s: IsLeader() = %v, want %v", tt.name, leader, tt.wantLeader)
+		}
+		if holder, transitions := store.holder(); holder != tt.wantHolder || transitions != tt.wantTrans {
+			t.Errorf("%s: lease held by %q after %d transitions, want %q after %d", tt.name, holder, transitions, tt.wantHolder, tt.wantTrans)
+		}
+		select {
+		case identity := <-started:
+			if !tt.wantStart || identity != tt.elector.identity {
+				t.Errorf("%s: %s started leading", tt.name, identity)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tt.wantStart {
+				t.Errorf("%s: %s did not start leading", tt.name, tt.elector.identity)
+			}
+		}
+	}
+
+	var disabled *leaderElector
+	if !disabled.IsLeader() {
+		t.Error("replica without leader election is not the leader")
+	}
+}
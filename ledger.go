@@ -0,0 +1,309 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFileLedger = "file:/var/lib/vault-controller/ledger.json"
+
+// defaultLedger returns the ledger used when VAULT_CONTROLLER_LEDGER is not
+// set. A file in the container does not survive a pod restart, so when
+// POD_NAMESPACE is set the records are kept in Secrets in that namespace.
+func defaultLedger() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return "secret:" + namespace + "/vault-controller-ledger"
+	}
+	return defaultFileLedger
+}
+
+// Delivery states of an issued token.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryRejected  = "rejected"
+	deliveryFailed    = "failed"
+
+	// deliveryIntercepted means the wrapping token was unwrapped by
+	// someone other than the pod.
+	deliveryIntercepted = "intercepted"
+)
+
+// IssuanceRecord describes a token issued to a pod. Records are keyed by
+// the token accessor; the token itself is never stored.
+type IssuanceRecord struct {
+	PodUID     string     `json:"pod_uid"`
+	Namespace  string     `json:"namespace"`
+	Name       string     `json:"name"`
+	Accessor   string     `json:"accessor"`
+	Policies   []string   `json:"policies"`
+	Role       string     `json:"role,omitempty"`
+	TTL        string     `json:"ttl"`
+	IssueTime  time.Time  `json:"issue_time"`
+	Delivery   string     `json:"delivery"`
+	Bindings   []string   `json:"bindings,omitempty"`
+	Vault      string     `json:"vault,omitempty"`
+	RevokeTime *time.Time `json:"revoke_time,omitempty"`
+
+	// VaultNamespace is the Vault Enterprise namespace the token lives in.
+	VaultNamespace string `json:"vault_namespace,omitempty"`
+
+	// Secrets lists the paths read with the token on behalf of the pod. Such
+	// tokens hold the leases of the secrets and are never delivered.
+	Secrets []string `json:"secrets,omitempty"`
+
+	// WrappingAccessor is the accessor of the response wrapping token the
+	// token was delivered in, and WrapExpiry the time it expires.
+	WrappingAccessor string     `json:"wrapping_accessor,omitempty"`
+	WrapExpiry       *time.Time `json:"wrap_expiry,omitempty"`
+}
+
+// Ledger stores issuance records so the controller can tell which tokens it
+// issued, and to which pods, across restarts.
+//
+// Update applies fn to the record for accessor as a single read-modify-write,
+// so concurrent writers from other replicas are not lost. It returns
+// errRecordNotFound if there is no such record. Reads are served from memory,
+// so ByPod can be called for every pod event.
+type Ledger interface {
+	Put(r *IssuanceRecord) error
+	Get(accessor string) (*IssuanceRecord, error)
+	Update(accessor string, fn func(r *IssuanceRecord)) error
+	Delete(accessor string) error
+	List() ([]*IssuanceRecord, error)
+	ByPod(podUID string) ([]*IssuanceRecord, error)
+}
+
+var errRecordNotFound = errors.New("ledger: record not found")
+
+// newLedger returns the ledger described by spec, which takes one of the
+// following forms:
+//
+//	file:<path>
+//	secret:<namespace>/<name>
+//	configmap:<namespace>/<name>
+func newLedger(spec string) (Ledger, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid ledger %q", spec)
+	}
+	switch parts[0] {
+	case "file":
+		return newFileLedger(parts[1])
+	case "secret", "configmap":
+		ref := strings.SplitN(parts[1], "/", 2)
+		if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+			return nil, fmt.Errorf("invalid ledger %q: expected %s:<namespace>/<name>", spec, parts[0])
+		}
+		l := newKubernetesLedger(kubeClient, parts[0], ref[0], ref[1])
+		if err := l.migrate(); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("invalid ledger %q: unknown backend %s", spec, parts[0])
+}
+
+// recordSet holds records by accessor and indexes them by pod UID. It
+// hands out copies, so callers may modify the records they get.
+type recordSet struct {
+	records map[string]*IssuanceRecord
+	byPod   map[string]map[string]bool
+}
+
+func newRecordSet() *recordSet {
+	return &recordSet{
+		records: make(map[string]*IssuanceRecord),
+		byPod:   make(map[string]map[string]bool),
+	}
+}
+
+func (s *recordSet) put(r *IssuanceRecord) {
+	s.remove(r.Accessor)
+	record := *r
+	s.records[r.Accessor] = &record
+	if s.byPod[r.PodUID] == nil {
+		s.byPod[r.PodUID] = make(map[string]bool)
+	}
+	s.byPod[r.PodUID][r.Accessor] = true
+}
+
+func (s *recordSet) remove(accessor string) {
+	r, ok := s.records[accessor]
+	if !ok {
+		return
+	}
+	delete(s.records, accessor)
+	delete(s.byPod[r.PodUID], accessor)
+	if len(s.byPod[r.PodUID]) == 0 {
+		delete(s.byPod, r.PodUID)
+	}
+}
+
+func (s *recordSet) get(accessor string) *IssuanceRecord {
+	r, ok := s.records[accessor]
+	if !ok {
+		return nil
+	}
+	record := *r
+	return &record
+}
+
+func (s *recordSet) list() []*IssuanceRecord {
+	records := make([]*IssuanceRecord, 0, len(s.records))
+	for _, r := range s.records {
+		record := *r
+		records = append(records, &record)
+	}
+	return records
+}
+
+func (s *recordSet) pod(podUID string) []*IssuanceRecord {
+	var records []*IssuanceRecord
+	for accessor := range s.byPod[podUID] {
+		records = append(records, s.get(accessor))
+	}
+	return records
+}
+
+// setDelivery updates the delivery state of the record for accessor.
+func setDelivery(l Ledger, accessor, delivery string) error {
+	return l.Update(accessor, func(r *IssuanceRecord) {
+		r.Delivery = delivery
+	})
+}
+
+// fileLedger keeps records in a JSON file on local disk. The file is
+// rewritten atomically on every change.
+type fileLedger struct {
+	path string
+
+	sync.Mutex
+	records *recordSet
+}
+
+func newFileLedger(path string) (*fileLedger, error) {
+	l := &fileLedger{
+		path:    path,
+		records: newRecordSet(),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("ledger: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %v", err)
+	}
+	records := make(map[string]*IssuanceRecord)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("ledger: error parsing %s: %v", path, err)
+	}
+	for _, r := range records {
+		l.records.put(r)
+	}
+	return l, nil
+}
+
+func (l *fileLedger) Put(r *IssuanceRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.save(r.Accessor, r); err != nil {
+		return err
+	}
+	l.records.put(r)
+	return nil
+}
+
+func (l *fileLedger) Get(accessor string) (*IssuanceRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.records.get(accessor), nil
+}
+
+func (l *fileLedger) Update(accessor string, fn func(r *IssuanceRecord)) error {
+	l.Lock()
+	defer l.Unlock()
+	r := l.records.get(accessor)
+	if r == nil {
+		return errRecordNotFound
+	}
+	fn(r)
+	if err := l.save(accessor, r); err != nil {
+		return err
+	}
+	l.records.put(r)
+	return nil
+}
+
+func (l *fileLedger) Delete(accessor string) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.records.get(accessor) == nil {
+		return nil
+	}
+	if err := l.save(accessor, nil); err != nil {
+		return err
+	}
+	l.records.remove(accessor)
+	return nil
+}
+
+func (l *fileLedger) List() ([]*IssuanceRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.records.list(), nil
+}
+
+func (l *fileLedger) ByPod(podUID string) ([]*IssuanceRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.records.pod(podUID), nil
+}
+
+// save writes the records to disk with the record for accessor replaced by
+// r, or removed when r is nil. The records in memory are left alone, so the
+// caller only changes them once the file has been written.
+func (l *fileLedger) save(accessor string, r *IssuanceRecord) error {
+	records := make(map[string]*IssuanceRecord, len(l.records.records)+1)
+	for k, v := range l.records.records {
+		records[k] = v
+	}
+	if r == nil {
+		delete(records, accessor)
+	} else {
+		records[accessor] = r
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ledgerDataKey          = "record.json"
+	legacyLedgerDataKey    = "ledger.json"
+	ledgerLabel            = "vaultproject.io/ledger"
+	ledgerPodUIDLabel      = "vaultproject.io/pod-uid"
+	maxLedgerWriteAttempts = 5
+)
+
+// kubernetesLedger keeps every record in a Secret or ConfigMap of its own,
+// named after the ledger and the token accessor and labelled with the ledger
+// name and pod UID. A single object holding all records would outgrow the
+// etcd object size limit on a large cluster. Writes use optimistic
+// concurrency, so the ledger can be shared by several controller replicas.
+//
+// Records are read from a cache kept in sync with a watch, which also picks
+// up the records written by other replicas. Run must be started, and
+// WaitForSync return, before the ledger is read.
+type kubernetesLedger struct {
+	client    *kubernetesClient
+	kind      string
+	namespace string
+	name      string
+
+	sync.RWMutex
+	records *recordSet
+	synced  bool
+}
+
+var errLedgerNotSynced = errors.New("ledger: not synced yet")
+
+func newKubernetesLedger(client *kubernetesClient, kind, namespace, name string) *kubernetesLedger {
+	return &kubernetesLedger{
+		client:    client,
+		kind:      kind,
+		namespace: namespace,
+		name:      name,
+		records:   newRecordSet(),
+	}
+}
+
+// Run keeps the record cache in sync with the API server until done is
+// closed.
+func (l *kubernetesLedger) Run(done <-chan struct{}) {
+	r := &reflector{
+		client:        l.client,
+		name:          "ledger",
+		path:          l.collectionPath(),
+		labelSelector: ledgerLabel + "=" + l.name,
+		replace:       l.replace,
+		apply:         l.apply,
+	}
+	r.Run(done)
+}
+
+// WaitForSync blocks until the first list has completed.
+func (l *kubernetesLedger) WaitForSync(done <-chan struct{}) bool {
+	for {
+		l.RLock()
+		synced := l.synced
+		l.RUnlock()
+		if synced {
+			return true
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (l *kubernetesLedger) replace(items []json.RawMessage) error {
+	records := newRecordSet()
+	for _, item := range items {
+		var object LedgerObject
+		if err := json.Unmarshal(item, &object); err != nil {
+			return err
+		}
+		r, err := l.decode(&object)
+		if err != nil {
+			log.Printf("%v; skipping", err)
+			continue
+		}
+		records.put(r)
+	}
+	l.Lock()
+	l.records = records
+	l.synced = true
+	l.Unlock()
+	return nil
+}
+
+func (l *kubernetesLedger) apply(eventType string, item json.RawMessage) error {
+	var object LedgerObject
+	if err := json.Unmarshal(item, &object); err != nil {
+		return err
+	}
+	r, err := l.decode(&object)
+	if err != nil {
+		log.Printf("%v; skipping", err)
+		return nil
+	}
+	l.Lock()
+	if eventType == "DELETED" {
+		l.records.remove(r.Accessor)
+	} else {
+		l.records.put(r)
+	}
+	l.Unlock()
+	return nil
+}
+
+// cached runs fn against the record cache once it has synced.
+func (l *kubernetesLedger) cached(fn func(records *recordSet)) error {
+	l.RLock()
+	defer l.RUnlock()
+	if !l.synced {
+		return errLedgerNotSynced
+	}
+	fn(l.records)
+	return nil
+}
+
+func (l *kubernetesLedger) collectionPath() string {
+	resource := "configmaps"
+	if l.kind == "secret" {
+		resource = "secrets"
+	}
+	return fmt.Sprintf("/api/v1/namespaces/%s/%s", l.namespace, resource)
+}
+
+// objectName returns the name of the object holding the record for
+// accessor. Accessors are not valid object names, so they are hashed.
+func (l *kubernetesLedger) objectName(accessor string) string {
+	sum := sha256.Sum256([]byte(accessor))
+	return fmt.Sprintf("%s-%x", l.name, sum[:10])
+}
+
+func (l *kubernetesLedger) objectPath(accessor string) string {
+	return l.collectionPath() + "/" + l.objectName(accessor)
+}
+
+// data returns the value stored under key in the object, decoding Secret
+// data.
+func (l *kubernetesLedger) data(object *LedgerObject, key string) ([]byte, error) {
+	if l.kind != "secret" {
+		return []byte(object.Data[key]), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(object.Data[key])
+	if err != nil {
+		return nil, fmt.Errorf("ledger: error decoding %s/%s: %v", l.namespace, object.Metadata.Name, err)
+	}
+	return data, nil
+}
+
+func (l *kubernetesLedger) decode(object *LedgerObject) (*IssuanceRecord, error) {
+	data, err := l.data(object, ledgerDataKey)
+	if err != nil {
+		return nil, err
+	}
+	var r IssuanceRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("ledger: error parsing %s/%s: %v", l.namespace, object.Metadata.Name, err)
+	}
+	return &r, nil
+}
+
+// get returns the record for accessor along with the object it was read
+// from. A nil object means there is no such record.
+func (l *kubernetesLedger) get(accessor string) (*IssuanceRecord, *LedgerObject, error) {
+	var object LedgerObject
+	err := l.client.do("GET", l.objectPath(accessor), nil, &object)
+	if isNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("ledger: %v", err)
+	}
+	r, err := l.decode(&object)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, &object, nil
+}
+
+// save writes the record to the object it was read from, or creates the
+// object when it is nil. The resource version read by get is sent along
+// with an update, so the API server rejects the write if another writer
+// got there first.
+func (l *kubernetesLedger) save(r *IssuanceRecord, object *LedgerObject) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	value := string(data)
+	if l.kind == "secret" {
+		value = base64.StdEncoding.EncodeToString(data)
+	}
+
+	if object == nil {
+		object = &LedgerObject{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   Metadata{Name: l.objectName(r.Accessor), Namespace: l.namespace},
+		}
+		if l.kind == "secret" {
+			object.Kind = "Secret"
+			object.Type = "Opaque"
+		}
+	}
+	object.Metadata.Labels = map[string]string{
+		ledgerLabel:       l.name,
+		ledgerPodUIDLabel: r.PodUID,
+	}
+	object.Data = map[string]string{ledgerDataKey: value}
+
+	if object.Metadata.ResourceVersion == "" {
+		err = l.client.do("POST", l.collectionPath(), object, nil)
+		if isAlreadyExists(err) {
+			// Another replica created the record first; treat it as a
+			// conflict so the caller reloads it.
+			return &apiError{Code: http.StatusConflict, Reason: "Conflict"}
+		}
+	} else {
+		err = l.client.do("PUT", l.collectionPath()+"/"+object.Metadata.Name, object, nil)
+	}
+	if err != nil && !isConflict(err) {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	if err == nil {
+		// Reads right after a write must not wait for the watch.
+		l.Lock()
+		l.records.put(r)
+		l.Unlock()
+	}
+	return err
+}
+
+// modify runs fn against the current record for accessor, which is nil
+// when there is none, and saves the record fn returns. Nothing is written
+// when fn returns nil. The whole cycle is retried when another replica
+// updated the record in the meantime.
+func (l *kubernetesLedger) modify(accessor string, fn func(r *IssuanceRecord) (*IssuanceRecord, error)) error {
+	var err error
+	for attempt := 0; attempt < maxLedgerWriteAttempts; attempt++ {
+		var (
+			current, next *IssuanceRecord
+			object        *LedgerObject
+		)
+		current, object, err = l.get(accessor)
+		if err != nil {
+			return err
+		}
+		next, err = fn(current)
+		if err != nil || next == nil {
+			return err
+		}
+		err = l.save(next, object)
+		if !isConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (l *kubernetesLedger) Put(r *IssuanceRecord) error {
+	return l.modify(r.Accessor, func(*IssuanceRecord) (*IssuanceRecord, error) {
+		return r, nil
+	})
+}
+
+func (l *kubernetesLedger) Get(accessor string) (*IssuanceRecord, error) {
+	var r *IssuanceRecord
+	err := l.cached(func(records *recordSet) {
+		r = records.get(accessor)
+	})
+	return r, err
+}
+
+func (l *kubernetesLedger) Update(accessor string, fn func(r *IssuanceRecord)) error {
+	return l.modify(accessor, func(r *IssuanceRecord) (*IssuanceRecord, error) {
+		if r == nil {
+			return nil, errRecordNotFound
+		}
+		fn(r)
+		return r, nil
+	})
+}
+
+func (l *kubernetesLedger) Delete(accessor string) error {
+	err := l.client.do("DELETE", l.objectPath(accessor), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	l.Lock()
+	l.records.remove(accessor)
+	l.Unlock()
+	return nil
+}
+
+func (l *kubernetesLedger) List() ([]*IssuanceRecord, error) {
+	var result []*IssuanceRecord
+	err := l.cached(func(records *recordSet) {
+		result = records.list()
+	})
+	return result, err
+}
+
+func (l *kubernetesLedger) ByPod(podUID string) ([]*IssuanceRecord, error) {
+	var result []*IssuanceRecord
+	err := l.cached(func(records *recordSet) {
+		result = records.pod(podUID)
+	})
+	return result, err
+}
+
+// migrate moves the records of a ledger kept in a single object, as written
+// by earlier versions, to an object per record and deletes the old object.
+func (l *kubernetesLedger) migrate() error {
+	var object LedgerObject
+	err := l.client.do("GET", l.collectionPath()+"/"+l.name, nil, &object)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	data, err := l.data(&object, legacyLedgerDataKey)
+	if err != nil {
+		return err
+	}
+	records := make(map[string]*IssuanceRecord)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return fmt.Errorf("ledger: error parsing %s/%s: %v", l.namespace, l.name, err)
+		}
+	}
+	for _, r := range records {
+		r := r
+		// Records already migrated by another replica may have changed
+		// since.
+		err := l.modify(r.Accessor, func(current *IssuanceRecord) (*IssuanceRecord, error) {
+			if current != nil {
+				return nil, nil
+			}
+			return r, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = l.client.do("DELETE", l.collectionPath()+"/"+l.name, nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("ledger: %v", err)
+	}
+	log.Printf("ledger: migrated %d records from %s/%s to an object per record", len(records), l.namespace, l.name)
+	return nil
+}
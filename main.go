@@ -12,46 +12,239 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
-	"github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var vaultClient *api.Client
+var (
+	vaults           *vaultBackends
+	kubeClient       *kubernetesClient
+	podStore         *podCache
+	revoker          *tokenRevoker
+	ledger           Ledger
+	pushMode         bool
+	elector          *leaderElector
+	policyBindings   *bindingCache
+	controllerConfig *Config
+	forwardedHeader  string
+	trustedProxies   []*net.IPNet
+	tokenAudiences   = []string{defaultTokenAudience}
+)
 
 func main() {
+	auditKey = []byte(os.Getenv("VAULT_CONTROLLER_AUDIT_KEY"))
+
+	// "vault-controller verify-audit-log [-from <seq>:<hash>] [-to
+	// <seq>:<hash>] <file>..." checks the hash chain of audit log files
+	// given oldest first.
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit-log" {
+		verifyAuditLogCommand(os.Args[2:])
+		return
+	}
+
 	log.Println("Starting vault-controller app...")
 
-	if os.Getenv("VAULT_TOKEN") == "" {
-		log.Fatal("VAULT_TOKEN must be set and non-empty")
+	if len(auditKey) == 0 {
+		log.Println("VAULT_CONTROLLER_AUDIT_KEY is not set; the audit log chain is not keyed and can be rebuilt by anyone who can write to it")
 	}
+
 	if os.Getenv("VAULT_WRAP_TTL") == "" {
 		os.Setenv("VAULT_WRAP_TTL", "120")
 	}
 
+	forwardedHeader = os.Getenv("VAULT_CONTROLLER_FORWARDED_HEADER")
+	if proxies := os.Getenv("VAULT_CONTROLLER_TRUSTED_PROXIES"); proxies != "" {
+		for _, cidr := range strings.Split(proxies, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Fatalf("invalid VAULT_CONTROLLER_TRUSTED_PROXIES entry %q: %s", cidr, err)
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+	if forwardedHeader != "" && len(trustedProxies) == 0 {
+		log.Fatal("VAULT_CONTROLLER_TRUSTED_PROXIES must be set when VAULT_CONTROLLER_FORWARDED_HEADER is set")
+	}
+
+	if audiences := os.Getenv("VAULT_CONTROLLER_TOKEN_AUDIENCES"); audiences != "" {
+		tokenAudiences = strings.Split(audiences, ",")
+	}
+
+	maxSize := int64(defaultAuditLogMaxSize)
+	if v := os.Getenv("VAULT_CONTROLLER_AUDIT_LOG_MAX_SIZE"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 0 {
+			log.Fatalf("invalid VAULT_CONTROLLER_AUDIT_LOG_MAX_SIZE %q", v)
+		}
+		maxSize = int64(mb) << 20
+	}
+	maxBackups := defaultAuditLogMaxBackups
+	if v := os.Getenv("VAULT_CONTROLLER_AUDIT_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid VAULT_CONTROLLER_AUDIT_LOG_MAX_BACKUPS %q", v)
+		}
+		maxBackups = n
+	}
 	var err error
-	config := api.DefaultConfig()
-	vaultClient, err = api.NewClient(config)
+	auditLog, err = newAuditSink(os.Getenv("VAULT_CONTROLLER_AUDIT_LOG"), maxSize, maxBackups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	controllerConfig, err = loadConfig(os.Getenv("VAULT_CONTROLLER_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	setupRateLimits(controllerConfig)
+
+	maxNamespaces := defaultMetricsMaxNamespaces
+	if v := os.Getenv("VAULT_CONTROLLER_METRICS_MAX_NAMESPACES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid VAULT_CONTROLLER_METRICS_MAX_NAMESPACES %q", v)
+		}
+		maxNamespaces = n
+	}
+	registerMetrics(maxNamespaces)
+
+	vaults, err = newVaultBackends(controllerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kubeClient, err = newKubernetesClient(os.Getenv("KUBECONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	if err := vaults.Run(done); err != nil {
+		log.Fatal(err)
+	}
+	vaults.checkRoles(controllerConfig)
+
+	ledgerSpec := os.Getenv("VAULT_CONTROLLER_LEDGER")
+	if ledgerSpec == "" {
+		ledgerSpec = defaultLedger()
+	}
+	ledger, err = newLedger(ledgerSpec)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if l, ok := ledger.(*kubernetesLedger); ok {
+		go l.Run(done)
+		l.WaitForSync(done)
+	}
+
+	if os.Getenv("VAULT_CONTROLLER_LEADER_ELECTION") == "true" {
+		if strings.HasPrefix(ledgerSpec, "file:") {
+			log.Fatal("leader election requires a secret or configmap ledger shared by all replicas")
+		}
+		namespace := os.Getenv("POD_NAMESPACE")
+		identity := os.Getenv("POD_NAME")
+		if namespace == "" || identity == "" {
+			log.Fatal("POD_NAME and POD_NAMESPACE must be set when leader election is enabled")
+		}
+		elector = newLeaderElector(kubeClient, namespace, "vault-controller", identity)
+	}
+
+	go events.Run(done)
+
+	revoker = newTokenRevoker(ledger)
+	go revoker.Run(done)
+
+	if os.Getenv("VAULT_CONTROLLER_POLICY_BINDINGS") == "true" {
+		log.Println("Watching VaultPolicyBinding resources.")
+		policyBindings = newBindingCache(kubeClient)
+		go policyBindings.Run(done)
+		// Pods are cached based on the bindings that select them.
+		policyBindings.WaitForSync(done)
+	}
+
+	podStore = newPodCache(kubeClient)
+	podStore.AddHandler(revoker.HandlePodEvent)
+	elector.OnStartedLeading(revoker.Reconcile)
+
+	pushMode = os.Getenv("VAULT_CONTROLLER_PUSH_MODE") == "true"
+	if pushMode {
+		log.Println("Push mode enabled; tokens will be pushed to annotated pods.")
+		pusher := newTokenPusher(done)
+		podStore.AddHandler(pusher.HandlePodEvent)
+		elector.OnStartedLeading(func() {
+			podStore.Resync(pusher.HandlePodEvent)
+		})
+	}
+	go podStore.Run(done)
+
+	if elector != nil {
+		go elector.Run(done)
+	}
 
 	http.Handle("/token", handler{tokenRequestHandler})
+	http.Handle("/revoke", handler{revokeRequestHandler})
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	go func() {
 		log.Fatal(http.ListenAndServe(":80", nil))
 	}()
 
+	if path := os.Getenv("VAULT_CONTROLLER_WEBHOOK_CONFIG"); path != "" {
+		webhook, err := loadWebhookConfig(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go startWebhook(webhook)
+	}
+
 	log.Println("Listening for token requests.")
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Printf("Shutdown signal received, exiting...")
+	close(done)
+}
+
+func verifyAuditLogCommand(args []string) {
+	flags := flag.NewFlagSet("verify-audit-log", flag.ExitOnError)
+	from := flags.String("from", "", "checkpoint `<seq>:<hash>` the first record follows; defaults to the start of the chain")
+	to := flags.String("to", "", "checkpoint `<seq>:<hash>` the last record must match")
+	flags.Parse(args)
+
+	start := genesisCheckpoint()
+	if *from != "" {
+		var err error
+		if start, err = parseAuditCheckpoint(*from); err != nil {
+			log.Fatal(err)
+		}
+	}
+	last, err := verifyAuditLogFiles(flags.Args(), start)
+	if err != nil {
+		log.Fatalf("audit log verification failed: %v", err)
+	}
+	if *to != "" {
+		end, err := parseAuditCheckpoint(*to)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if last != end {
+			log.Fatalf("audit log verification failed: log ends at %s, expected %s; records are missing from the end", last, end)
+		}
+	}
+	log.Printf("audit log verified; last record is %s", last)
 }
 
 type handler struct {
@@ -60,6 +253,9 @@ type handler struct {
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	code, err := h.f(w, r)
+	if e, ok := err.(*retryAfterError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.after.Seconds()))))
+	}
 	w.WriteHeader(code)
 	if err != nil {
 		log.Printf("%v", err)
@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMetricsMaxNamespaces = 100
+
+	// Label values used instead of a namespace name.
+	otherNamespace   = "_other"
+	unknownNamespace = "_unknown"
+)
+
+var (
+	tokenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vault_controller",
+		Name:      "token_requests_total",
+		Help:      "Token requests by namespace, audit decision and HTTP status code.",
+	}, []string{"namespace", "outcome", "code"})
+
+	vaultCreateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vault_controller",
+		Name:      "vault_create_errors_total",
+		Help:      "Failed Vault token create calls by namespace and Vault backend.",
+	}, []string{"namespace", "vault"})
+
+	tokenPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vault_controller",
+		Name:      "token_pushes_total",
+		Help:      "Pushes of wrapped tokens to vault-init by namespace and delivery state.",
+	}, []string{"namespace", "outcome"})
+
+	podLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vault_controller",
+		Name:      "pod_lookup_duration_seconds",
+		Help:      "Time taken to look up the pod named by a token request by namespace.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"namespace"})
+
+	vaultCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vault_controller",
+		Name:      "vault_create_duration_seconds",
+		Help:      "Time taken by Vault token create calls by namespace and Vault backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "vault"})
+
+	tokenPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vault_controller",
+		Name:      "token_push_duration_seconds",
+		Help:      "Time taken to push a wrapped token to vault-init by namespace and delivery state.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "outcome"})
+
+	trackedTokensDesc = prometheus.NewDesc(
+		"vault_controller_tracked_tokens",
+		"Tokens recorded in the ledger that have not been revoked, by namespace.",
+		[]string{"namespace"}, nil,
+	)
+
+	vaultTokenTTLDesc = prometheus.NewDesc(
+		"vault_controller_vault_token_ttl_seconds",
+		"Remaining TTL of the controller's own Vault token by Vault backend; 0 for tokens that do not expire.",
+		[]string{"vault"}, nil,
+	)
+)
+
+// metricsNamespaces bounds the number of distinct namespace label values.
+// Namespaces seen after the limit is reached are reported as _other.
+var metricsNamespaces = &namespaceLabels{
+	max:  defaultMetricsMaxNamespaces,
+	seen: make(map[string]bool),
+}
+
+type namespaceLabels struct {
+	max int
+
+	sync.Mutex
+	seen map[string]bool
+}
+
+// label returns the label value for the namespace.
+func (n *namespaceLabels) label(namespace string) string {
+	if namespace == "" {
+		return unknownNamespace
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.seen[namespace] {
+		return namespace
+	}
+	if len(n.seen) >= n.max {
+		return otherNamespace
+	}
+	n.seen[namespace] = true
+	return namespace
+}
+
+// requestNamespaceLabel returns the namespace label of a request. Requests
+// that were not traced to a pod name a namespace chosen by the caller, so
+// they are not labelled with it.
+func requestNamespaceLabel(e *auditEntry) string {
+	if e.PodUID == "" {
+		return unknownNamespace
+	}
+	return metricsNamespaces.label(e.Namespace)
+}
+
+// controllerCollector reports state read at scrape time.
+type controllerCollector struct{}
+
+func (controllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trackedTokensDesc
+	ch <- vaultTokenTTLDesc
+}
+
+func (controllerCollector) Collect(ch chan<- prometheus.Metric) {
+	if records, err := ledger.List(); err != nil {
+		log.Printf("metrics: error reading ledger: %v", err)
+	} else {
+		counts := make(map[string]int)
+		for _, r := range records {
+			if r.RevokeTime == nil {
+				counts[metricsNamespaces.label(r.Namespace)]++
+			}
+		}
+		for namespace, n := range counts {
+			ch <- prometheus.MustNewConstMetric(trackedTokensDesc, prometheus.GaugeValue, float64(n), namespace)
+		}
+	}
+
+	for name, b := range vaults.backends {
+		ttl := b.auth.TTL()
+		ch <- prometheus.MustNewConstMetric(vaultTokenTTLDesc, prometheus.GaugeValue, ttl.Seconds(), name)
+	}
+}
+
+// registerMetrics registers the controller metrics with the default
+// registry. maxNamespaces bounds the namespace label values.
+func registerMetrics(maxNamespaces int) {
+	if maxNamespaces > 0 {
+		metricsNamespaces.max = maxNamespaces
+	}
+	prometheus.MustRegister(
+		tokenRequests,
+		vaultCreateErrors,
+		tokenPushes,
+		podLookupDuration,
+		vaultCreateDuration,
+		tokenPushDuration,
+		controllerCollector{},
+	)
+}
+
+func observeSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
@@ -31,6 +31,7 @@ type PKIConfig struct {
 	DNSNames    []string
 	IPAddresses []string
 	IssuePath   string
+	Namespace   string
 	Token       string
 	TTL         string
 }
@@ -91,6 +92,9 @@ func (cm *CertificateManager) SetCertificate() error {
 		return fmt.Errorf("certificate manager: error creating pki request: %v", err)
 	}
 	request.Header.Add("X-Vault-Token", cm.PKIConfig.Token)
+	if cm.PKIConfig.Namespace != "" {
+		request.Header.Add("X-Vault-Namespace", cm.PKIConfig.Namespace)
+	}
 
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
@@ -103,7 +107,7 @@ func (cm *CertificateManager) SetCertificate() error {
 		return fmt.Errorf("certificate manager: error reading pki response: %v", err)
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf(string(data))
+		return fmt.Errorf("certificate manager: pki request failed: %s", data)
 	}
 
 	var secret PKIIssueSecret
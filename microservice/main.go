@@ -29,21 +29,22 @@ import (
 const tokenFile = "/var/run/secrets/vaultproject.io/secret.json"
 
 var (
-	addr          string
-	clientPKIPath string
-	clientPKITTL  string
-	clusterDomain string
-	hostname      string
-	ip            string
-	name          string
-	namespace     string
-	remoteAddr    string
-	serverPKIPath string
-	serverPKITTL  string
-	serviceName   string
-	subdomain     string
-	vaultAddr     string
-	vaultToken    string
+	addr           string
+	clientPKIPath  string
+	clientPKITTL   string
+	clusterDomain  string
+	hostname       string
+	ip             string
+	name           string
+	namespace      string
+	remoteAddr     string
+	serverPKIPath  string
+	serverPKITTL   string
+	serviceName    string
+	subdomain      string
+	vaultAddr      string
+	vaultNamespace string
+	vaultToken     string
 )
 
 func main() {
@@ -61,6 +62,7 @@ func main() {
 	flag.StringVar(&serviceName, "service-name", "", "Kubernetes service name that resolves to this Pod")
 	flag.StringVar(&subdomain, "subdomain", "", "subdomain as defined by pod.spec.subdomain")
 	flag.StringVar(&vaultAddr, "vault-addr", "https://vault:8200", "Vault service address")
+	flag.StringVar(&vaultNamespace, "vault-namespace", "", "Vault namespace; defaults to the namespace recorded in the secret file")
 	flag.Parse()
 
 	var wg sync.WaitGroup
@@ -70,6 +72,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if vaultNamespace != "" {
+		tm.Namespace = vaultNamespace
+	}
+	vaultNamespace = tm.Namespace
 	vaultToken = tm.Token
 	go tm.StartRenewToken()
 
@@ -98,6 +104,7 @@ func startServer() {
 		DNSNames:    dnsNames(serviceName, ip, hostname, subdomain, namespace, clusterDomain),
 		IPAddresses: ipAddresses,
 		IssuePath:   serverPKIPath,
+		Namespace:   vaultNamespace,
 		Token:       vaultToken,
 		TTL:         serverPKITTL,
 	}
@@ -134,6 +141,7 @@ func startClient(done <-chan bool, wg *sync.WaitGroup) {
 		Addr:       vaultAddr,
 		CommonName: podDomainName(ip, namespace, clusterDomain),
 		IssuePath:  clientPKIPath,
+		Namespace:  vaultNamespace,
 		Token:      vaultToken,
 		TTL:        clientPKITTL,
 	}
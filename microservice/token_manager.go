@@ -22,10 +22,11 @@ import (
 )
 
 type TokenManager struct {
-	addr  string
-	Token string
-	wg    *sync.WaitGroup
-	done  chan bool
+	addr      string
+	Token     string
+	Namespace string
+	wg        *sync.WaitGroup
+	done      chan bool
 }
 
 func NewTokenManager(addr, tokenFile string) (*TokenManager, error) {
@@ -42,10 +43,11 @@ func NewTokenManager(addr, tokenFile string) (*TokenManager, error) {
 	}
 
 	tm := &TokenManager{
-		addr:  addr,
-		Token: secret.Auth.ClientToken,
-		done:  make(chan bool),
-		wg:    &sync.WaitGroup{},
+		addr:      addr,
+		Token:     secret.Auth.ClientToken,
+		Namespace: secret.VaultNamespace,
+		done:      make(chan bool),
+		wg:        &sync.WaitGroup{},
 	}
 	return tm, nil
 }
@@ -68,6 +70,9 @@ func (tm *TokenManager) StartRenewToken() {
 			continue
 		}
 		request.Header.Add("X-Vault-Token", tm.Token)
+		if tm.Namespace != "" {
+			request.Header.Add("X-Vault-Namespace", tm.Namespace)
+		}
 
 		resp, err := http.DefaultClient.Do(request)
 		if err != nil {
@@ -10,6 +10,10 @@ type Secret struct {
 	Warnings      []string        `json:"warnings"`
 	WrapInfo      *SecretWrapInfo `json:"wrap_info,omitempty"`
 	Auth          *SecretAuth     `json:"auth,omitempty"`
+
+	// VaultNamespace is the Vault namespace the token was created in. It is
+	// added by vault-init and empty for the root namespace.
+	VaultNamespace string `json:"vault_namespace,omitempty"`
 }
 
 type SecretAuth struct {
@@ -0,0 +1,191 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+const vaultAnnotationPrefix = "vaultproject.io/"
+
+// podEventHandler is notified of every pod event seen by the cache, not only
+// the events for pods that carry vaultproject.io annotations.
+type podEventHandler func(eventType string, pod *Pod)
+
+// podCache is a list/watch backed cache of the pods that carry
+// vaultproject.io annotations or are selected by a VaultPolicyBinding.
+type podCache struct {
+	client   *kubernetesClient
+	handlers []podEventHandler
+
+	sync.RWMutex
+	pods map[string]*Pod
+}
+
+func newPodCache(client *kubernetesClient) *podCache {
+	return &podCache{
+		client: client,
+		pods:   make(map[string]*Pod),
+	}
+}
+
+// AddHandler registers h to receive pod events. Handlers must be added
+// before Run is called.
+func (pc *podCache) AddHandler(h podEventHandler) {
+	pc.handlers = append(pc.handlers, h)
+}
+
+func (pc *podCache) notify(eventType string, pod *Pod) {
+	for _, h := range pc.handlers {
+		h(eventType, pod)
+	}
+}
+
+// Resync calls h for every cached pod.
+func (pc *podCache) Resync(h podEventHandler) {
+	pc.RLock()
+	pods := make([]*Pod, 0, len(pc.pods))
+	for _, pod := range pc.pods {
+		pods = append(pods, pod)
+	}
+	pc.RUnlock()
+	for _, pod := range pods {
+		h("ADDED", pod)
+	}
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// wanted reports whether the pod is kept in the cache: it carries
+// vaultproject.io annotations or is selected by a VaultPolicyBinding.
+func wanted(pod *Pod) bool {
+	return hasVaultAnnotations(pod) || len(policyBindings.Match(pod)) > 0
+}
+
+func hasVaultAnnotations(pod *Pod) bool {
+	for k := range pod.Metadata.Annotations {
+		if strings.HasPrefix(k, vaultAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the cached pod if present. The pod is only returned when its
+// UID matches uid, unless uid is empty.
+func (pc *podCache) Get(namespace, name, uid string) (*Pod, bool) {
+	pc.RLock()
+	defer pc.RUnlock()
+	pod, ok := pc.pods[podKey(namespace, name)]
+	if !ok || (uid != "" && pod.Metadata.Uid != uid) {
+		return nil, false
+	}
+	return pod, true
+}
+
+// Lookup returns the pod from the cache, falling back to a GET against the
+// API server on a cache miss or when the cached pod has no IP yet.
+func (pc *podCache) Lookup(namespace, name, uid string) (*Pod, error) {
+	if pod, ok := pc.Get(namespace, name, uid); ok && pod.Status.PodIP != "" {
+		return pod, nil
+	}
+	pod, err := pc.client.getPod(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	pc.update(pod)
+	return pod, nil
+}
+
+func (pc *podCache) update(pod *Pod) {
+	key := podKey(pod.Metadata.Namespace, pod.Metadata.Name)
+	pc.Lock()
+	defer pc.Unlock()
+	if !wanted(pod) {
+		delete(pc.pods, key)
+		return
+	}
+	pc.pods[key] = pod
+}
+
+func (pc *podCache) delete(pod *Pod) {
+	pc.Lock()
+	delete(pc.pods, podKey(pod.Metadata.Namespace, pod.Metadata.Name))
+	pc.Unlock()
+}
+
+// Run keeps the cache in sync with the API server until done is closed.
+func (pc *podCache) Run(done <-chan struct{}) {
+	r := &reflector{
+		client:  pc.client,
+		name:    "pod cache",
+		path:    "/api/v1/pods",
+		replace: pc.replace,
+		apply:   pc.apply,
+		// Pods a binding starts selecting are only cached after a relist.
+		relist: policyBindings.SelectionChanged(),
+	}
+	r.Run(done)
+}
+
+func (pc *podCache) replace(items []json.RawMessage) error {
+	list := make([]*Pod, 0, len(items))
+	pods := make(map[string]*Pod)
+	listed := make(map[string]bool, len(items))
+	for _, item := range items {
+		var pod Pod
+		if err := json.Unmarshal(item, &pod); err != nil {
+			return err
+		}
+		list = append(list, &pod)
+		listed[pod.Metadata.Uid] = true
+		if wanted(&pod) {
+			pods[podKey(pod.Metadata.Namespace, pod.Metadata.Name)] = &pod
+		}
+	}
+
+	pc.Lock()
+	previous := pc.pods
+	pc.pods = pods
+	pc.Unlock()
+
+	// Pods removed while no watch was running are reported as deleted.
+	// Pods that still exist but are no longer wanted are only dropped from
+	// the cache.
+	for _, pod := range previous {
+		if !listed[pod.Metadata.Uid] {
+			pc.notify("DELETED", pod)
+		}
+	}
+	for _, pod := range list {
+		pc.notify("ADDED", pod)
+	}
+	return nil
+}
+
+func (pc *podCache) apply(eventType string, object json.RawMessage) error {
+	var pod Pod
+	if err := json.Unmarshal(object, &pod); err != nil {
+		return err
+	}
+	if eventType == "DELETED" {
+		pc.delete(&pod)
+	} else {
+		pc.update(&pod)
+	}
+	pc.notify(eventType, &pod)
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPodCacheReplace(t *testing.T) {
+	pod := func(name, uid string, annotated bool) json.RawMessage {
+		p := Pod{}
+		p.Metadata.Namespace = "default"
+		p.Metadata.Name = name
+		p.Metadata.Uid = uid
+		if annotated {
+			p.Metadata.Annotations = map[string]string{"vaultproject.io/policies": "web"}
+		}
+		data, _ := json.Marshal(&p)
+		return data
+	}
+
+	var events []string
+	pc := newPodCache(nil)
+	pc.AddHandler(func(eventType string, pod *Pod) {
+		events = append(events, eventType+":"+pod.Metadata.Name)
+	})
+
+	if err := pc.replace([]json.RawMessage{pod("a", "1", true), pod("b", "2", true), pod("c", "3", true)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lost its annotations, b is gone and c was replaced by a new pod
+	// with the same name.
+	events = nil
+	if err := pc.replace([]json.RawMessage{pod("a", "1", false), pod("c", "4", true)}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ADDED:a", "ADDED:c"}
+	deleted := map[string]bool{}
+	var added []string
+	for _, e := range events {
+		if strings.HasPrefix(e, "DELETED:") {
+			deleted[strings.TrimPrefix(e, "DELETED:")] = true
+		} else {
+			added = append(added, e)
+		}
+	}
+	if !reflect.DeepEqual(deleted, map[string]bool{"b": true, "c": true}) {
+		t.Errorf("deleted %v, want b and c", deleted)
+	}
+	if !reflect.DeepEqual(added, want) {
+		t.Errorf("added %v, want %v", added, want)
+	}
+	if _, ok := pc.Get("default", "a", ""); ok {
+		t.Error("pod without annotations is still cached")
+	}
+	if _, ok := pc.Get("default", "c", "4"); !ok {
+		t.Error("new pod c is not cached")
+	}
+}
+
+func TestPodCacheBindingAddedAfterPod(t *testing.T) {
+	defer func(bc *bindingCache) { policyBindings = bc }(policyBindings)
+	policyBindings = newBindingCache(nil)
+	if err := policyBindings.replace(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Pod{}
+	p.Metadata.Namespace = "default"
+	p.Metadata.Name = "web"
+	p.Metadata.Uid = "1"
+	p.Metadata.Labels = map[string]string{"app": "web"}
+	pod, _ := json.Marshal(&p)
+
+	pc := newPodCache(nil)
+	if err := pc.apply("ADDED", pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pc.Get("default", "web", ""); ok {
+		t.Fatal("pod selected by no binding is cached")
+	}
+
+	b := VaultPolicyBinding{}
+	b.Metadata.Namespace = "default"
+	b.Metadata.Name = "web"
+	b.Spec.PodSelector = &LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	b.Spec.Policies = []string{"web"}
+	binding, _ := json.Marshal(&b)
+	if err := policyBindings.apply("ADDED", binding); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-policyBindings.SelectionChanged():
+	default:
+		t.Fatal("adding a binding did not request a pod relist")
+	}
+
+	// The relist caches the pod the new binding selects.
+	if err := pc.replace([]json.RawMessage{pod}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pc.Get("default", "web", "1"); !ok {
+		t.Fatal("pod selected by the new binding is not cached after a relist")
+	}
+
+	// Status updates do not request another relist.
+	b.Status.MatchedPods = 1
+	binding, _ = json.Marshal(&b)
+	if err := policyBindings.apply("MODIFIED", binding); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-policyBindings.SelectionChanged():
+		t.Error("a status update requested a pod relist")
+	default:
+	}
+}
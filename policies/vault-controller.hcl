@@ -0,0 +1,32 @@
+# Policy for the Vault Controller token.
+
+# Create tokens through the token roles pods may name with the
+# vaultproject.io/role annotation. Restrict the glob to the roles the
+# controller should hand out.
+path "auth/token/create/*" {
+  capabilities = ["update"]
+}
+
+# Check that the token roles create orphan tokens, which outlive the
+# controller's own token.
+path "auth/token/roles/*" {
+  capabilities = ["read"]
+}
+
+# Revoke tokens issued to pods that no longer exist.
+path "auth/token/revoke-accessor" {
+  capabilities = ["update"]
+}
+
+# Check whether a wrapping token was unwrapped before it reached the pod.
+path "auth/token/lookup-accessor" {
+  capabilities = ["update"]
+}
+
+# Only needed when pods request raw policies without a role. Creating
+# orphan tokens with arbitrary policies requires sudo, so leave this out
+# when every pod uses a role.
+#
+# path "auth/token/create" {
+#   capabilities = ["update", "sudo"]
+# }
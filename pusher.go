@@ -0,0 +1,247 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	pushRetryDelay = 5 * time.Second
+
+	// maxPushTokens is how many tokens are issued to a pod whose wrapping
+	// tokens keep expiring before vault-init accepts one. A pod that never
+	// answers, or always refuses the push, would otherwise get a new Vault
+	// token every wrap TTL for as long as it runs.
+	maxPushTokens = 5
+)
+
+// tokenPusher issues and pushes wrapped tokens to annotated pods as soon as
+// they have a pod IP, without waiting for a token request. Each delivery
+// attempt runs on pushPool, and the worker is freed between attempts, which
+// token requests leave alone in push mode.
+type tokenPusher struct {
+	done <-chan struct{}
+
+	sync.Mutex
+	// scheduled holds the pods with an attempt running or waiting to run.
+	scheduled map[string]bool
+	// finished holds the pods that need no further deliveries, so the pod
+	// updates that keep arriving for them cost a map lookup.
+	finished map[string]bool
+	// states holds the delivery progress of the pods not yet finished.
+	states map[string]*pushState
+}
+
+// pushState is the delivery progress for one pod.
+type pushState struct {
+	// token is the token being pushed; nil when a new one must be issued.
+	token *wrappedToken
+	// issued counts the tokens issued to the pod.
+	issued int
+}
+
+func newTokenPusher(done <-chan struct{}) *tokenPusher {
+	return &tokenPusher{
+		done:      done,
+		scheduled: make(map[string]bool),
+		finished:  make(map[string]bool),
+		states:    make(map[string]*pushState),
+	}
+}
+
+// HandlePodEvent starts delivering a token to the pod once it is eligible
+// for one and has not received one yet.
+func (tp *tokenPusher) HandlePodEvent(eventType string, pod *Pod) {
+	uid := pod.Metadata.Uid
+	if eventType == "DELETED" || podTerminated(pod) {
+		tp.Lock()
+		delete(tp.finished, uid)
+		if !tp.scheduled[uid] {
+			delete(tp.states, uid)
+		}
+		tp.Unlock()
+		return
+	}
+	if !elector.IsLeader() {
+		return
+	}
+	if pod.Status.PodIP == "" || resolveGrant(pod).empty() {
+		return
+	}
+
+	tp.Lock()
+	if tp.scheduled[uid] || tp.finished[uid] {
+		tp.Unlock()
+		return
+	}
+	tp.scheduled[uid] = true
+	tp.Unlock()
+	tp.run(pod)
+}
+
+// run makes the next delivery attempt on a push worker. When every worker
+// is busy the pod is tried again after pushRetryDelay.
+func (tp *tokenPusher) run(pod *Pod) {
+	if !pushPool.Reserve() {
+		tp.after(pod, pushRetryDelay)
+		return
+	}
+	pushPool.Go(func() {
+		if delay, again := tp.attempt(pod); again {
+			tp.after(pod, delay)
+			return
+		}
+		tp.Lock()
+		delete(tp.scheduled, pod.Metadata.Uid)
+		tp.Unlock()
+	})
+}
+
+// after makes the next attempt with the latest version of the pod once
+// delay has passed. Delivery stops if by then the pod is gone or has
+// terminated, or this replica is no longer the leader.
+func (tp *tokenPusher) after(pod *Pod, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case <-tp.done:
+			tp.stop(pod.Metadata.Uid)
+			return
+		default:
+		}
+		current, ok := podStore.Get(pod.Metadata.Namespace, pod.Metadata.Name, pod.Metadata.Uid)
+		if !ok || podTerminated(current) || !elector.IsLeader() {
+			tp.stop(pod.Metadata.Uid)
+			return
+		}
+		tp.run(current)
+	})
+}
+
+// stop abandons delivery to the pod and revokes the token being pushed.
+func (tp *tokenPusher) stop(uid string) {
+	tp.Lock()
+	state := tp.states[uid]
+	delete(tp.states, uid)
+	delete(tp.scheduled, uid)
+	tp.Unlock()
+	if state != nil && state.token != nil {
+		state.token.revoke()
+	}
+}
+
+// finish records that the pod needs no further deliveries.
+func (tp *tokenPusher) finish(uid string) {
+	tp.Lock()
+	tp.finished[uid] = true
+	delete(tp.states, uid)
+	tp.Unlock()
+}
+
+// delivered reports whether the ledger shows the pod already received a
+// token, or had one intercepted, in which case no other token is pushed.
+func (tp *tokenPusher) delivered(pod *Pod) (bool, error) {
+	records, err := ledger.ByPod(pod.Metadata.Uid)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		switch r.Delivery {
+		case deliveryDelivered, deliveryRejected, deliveryIntercepted:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// attempt issues a token for the pod if it has none being pushed, subject
+// to the same rate limits as token requests, and pushes it once. A new
+// token is issued after the wrapping token expires, up to maxPushTokens. It
+// returns whether another attempt is needed, and after how long.
+func (tp *tokenPusher) attempt(pod *Pod) (time.Duration, bool) {
+	uid := pod.Metadata.Uid
+	name := podKey(pod.Metadata.Namespace, pod.Metadata.Name)
+	tp.Lock()
+	state := tp.states[uid]
+	if state == nil {
+		state = &pushState{}
+		tp.states[uid] = state
+	}
+	tp.Unlock()
+
+	if state.token == nil {
+		delivered, err := tp.delivered(pod)
+		if err != nil {
+			log.Printf("token push: error reading ledger for pod %s: %v; retrying in %v", name, err, pushRetryDelay)
+			return pushRetryDelay, true
+		}
+		if delivered {
+			tp.finish(uid)
+			return 0, false
+		}
+		if state.issued >= maxPushTokens {
+			log.Printf("token push: giving up on pod %s after %d tokens expired before delivery", name, state.issued)
+			recordEvent(pod, eventWarning, reasonTokenPushFailed, fmt.Sprintf("Gave up pushing a token after %d wrapped tokens expired before vault-init accepted one", state.issued))
+			tp.finish(uid)
+			return 0, false
+		}
+		if err := checkRateLimits(pod); err != nil {
+			delay := pushRetryDelay
+			if e, ok := err.(*retryAfterError); ok && e.after > delay {
+				delay = e.after
+			}
+			log.Printf("token push: %v; retrying in %v", err, delay)
+			return delay, true
+		}
+
+		entry := auditEntry{
+			Namespace: pod.Metadata.Namespace,
+			Name:      pod.Metadata.Name,
+			PodUID:    pod.Metadata.Uid,
+			PodIP:     pod.Status.PodIP,
+			start:     time.Now(),
+		}
+		token, code, err := issueToken(pod, &entry)
+		entry.finish(code, err)
+		audit(entry)
+		if err != nil {
+			if code < 500 {
+				// The pod is tried again when it changes.
+				log.Printf("token push: %v", err)
+				return 0, false
+			}
+			log.Printf("token push: %v; retrying in %v", err, pushRetryDelay)
+			return pushRetryDelay, true
+		}
+		log.Printf("token push: issued token for pod %s", name)
+		state.issued++
+		state.token = token
+	}
+
+	err := pushWrappedTokenTo(pod, state.token)
+	if err == nil || err == errTokenIntercepted {
+		tp.finish(uid)
+		return 0, false
+	}
+	if time.Now().Before(wrapExpiry(state.token.SecretWrapInfo)) {
+		return pushRetryDelay, true
+	}
+
+	log.Printf("token push: wrapped token for pod %s expired before delivery", name)
+	recordEvent(pod, eventWarning, reasonTokenPushFailed, "Wrapped token expired before it could be pushed to vault-init")
+	state.token.revoke()
+	state.token = nil
+	return 0, true
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// setupPushTest points the globals used by the token pusher at a fresh
+// file ledger, a revoker that only queues, and limits that let one token
+// through per pod. It returns a function restoring them.
+func setupPushTest(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newFileLedger(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldLedger, oldRevoker, oldElector := ledger, revoker, elector
+	oldPod, oldNamespace, oldPool := podLimiter, namespaceLimiter, pushPool
+	ledger = l
+	revoker = newTokenRevoker(l)
+	elector = nil
+	podLimiter = newKeyedLimiter(TokenBucket{Requests: 1, Per: "1h", Burst: 1})
+	namespaceLimiter = newKeyedLimiter(TokenBucket{Requests: 10, Per: "1h", Burst: 10})
+	pushPool = newWorkerPool(1)
+	return func() {
+		ledger, revoker, elector = oldLedger, oldRevoker, oldElector
+		podLimiter, namespaceLimiter, pushPool = oldPod, oldNamespace, oldPool
+		os.RemoveAll(dir)
+	}
+}
+
+// pushTestToken returns a pending token for the pod, recorded in the
+// ledger, whose wrapping token expires after ttl.
+func pushTestToken(t *testing.T, pod *Pod, accessor string, ttl time.Duration) *wrappedToken {
+	created := time.Now().Add(-time.Minute)
+	info := &api.SecretWrapInfo{
+		Accessor:        "wrapping-" + accessor,
+		WrappedAccessor: accessor,
+		CreationTime:    created,
+		TTL:             int((time.Minute + ttl) / time.Second),
+	}
+	expiry := wrapExpiry(info)
+	err := ledger.Put(&IssuanceRecord{
+		PodUID:           pod.Metadata.Uid,
+		Namespace:        pod.Metadata.Namespace,
+		Name:             pod.Metadata.Name,
+		Accessor:         accessor,
+		Delivery:         deliveryPending,
+		WrappingAccessor: info.Accessor,
+		WrapExpiry:       &expiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wrappedToken{SecretWrapInfo: info, vault: &vaultBackend{name: "default", client: vaultTestClient(t)}}
+}
+
+// vaultTestClient returns a client for a fake Vault that finds every
+// wrapping token accessor it is asked about.
+func vaultTestClient(t *testing.T) *api.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {}}`))
+	}))
+	t.Cleanup(server.Close)
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTokenPusherAttempt(t *testing.T) {
+	defer setupPushTest(t)()
+
+	tests := []struct {
+		name      string
+		status    int
+		delivered bool
+		issued    int
+		limited   bool
+		tokenTTL  time.Duration
+		wantDelay time.Duration
+		wantAgain bool
+		wantDone  bool
+		wantToken bool
+		revoked   int
+	}{
+		{name: "already delivered", delivered: true, wantDone: true},
+		{name: "too many tokens issued", issued: maxPushTokens, wantDone: true},
+		{name: "rate limited", limited: true, wantDelay: time.Hour, wantAgain: true},
+		{name: "pushed", status: 200, tokenTTL: time.Minute, wantDone: true},
+		{name: "already holds a token", status: 409, tokenTTL: time.Minute, wantDone: true, revoked: 1},
+		{name: "not listening yet", status: 503, tokenTTL: time.Minute, wantDelay: pushRetryDelay, wantAgain: true, wantToken: true},
+		{name: "wrapping token expired", status: 503, tokenTTL: -time.Second, wantAgain: true, revoked: 1},
+	}
+	for i, tt := range tests {
+		status := tt.status
+		podServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		pod := &Pod{
+			Metadata: Metadata{Namespace: "default", Name: "app", Uid: string(rune('a' + i))},
+			Status:   Status{PodIP: strings.TrimPrefix(podServer.URL, "http://")},
+		}
+		tp := newTokenPusher(make(chan struct{}))
+		state := &pushState{issued: tt.issued}
+		tp.states[pod.Metadata.Uid] = state
+		if tt.delivered {
+			if err := ledger.Put(&IssuanceRecord{PodUID: pod.Metadata.Uid, Accessor: tt.name, Delivery: deliveryDelivered}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.limited {
+			if err := checkRateLimits(pod); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.status != 0 {
+			state.issued = 1
+			state.token = pushTestToken(t, pod, tt.name, tt.tokenTTL)
+		}
+
+		delay, again := tp.attempt(pod)
+		podServer.Close()
+		if again != tt.wantAgain || (again && (delay < tt.wantDelay-time.Second || delay > tt.wantDelay)) {
+			t.Errorf("%s: attempt() = %v, %v; want %v, %v", tt.name, delay, again, tt.wantDelay, tt.wantAgain)
+		}
+		if done := tp.finished[pod.Metadata.Uid]; done != tt.wantDone {
+			t.Errorf("%s: finished = %v, want %v", tt.name, done, tt.wantDone)
+		}
+		if hasToken := state.token != nil; !tt.wantDone && hasToken != tt.wantToken {
+			t.Errorf("%s: pending token = %v, want %v", tt.name, hasToken, tt.wantToken)
+		}
+		if revoked := len(revoker.queue); revoked != tt.revoked {
+			t.Errorf("%s: %d tokens queued for revocation, want %d", tt.name, revoked, tt.revoked)
+		}
+		for len(revoker.queue) > 0 {
+			<-revoker.queue
+		}
+	}
+}
+
+func TestTokenPusherReleasesWorker(t *testing.T) {
+	defer setupPushTest(t)()
+
+	done := make(chan struct{})
+	defer close(done)
+	tp := newTokenPusher(done)
+	pod := &Pod{
+		Metadata: Metadata{Namespace: "default", Name: "app", Uid: "1"},
+		Status:   Status{PodIP: "127.0.0.1:1"},
+	}
+	if err := checkRateLimits(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	// The throttled pod waits for its next attempt without holding the
+	// only worker.
+	tp.scheduled[pod.Metadata.Uid] = true
+	tp.run(pod)
+	deadline := time.Now().Add(5 * time.Second)
+	for !pushPool.Reserve() {
+		if time.Now().After(deadline) {
+			t.Fatal("push worker still held while the pod waits to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pushPool.Release()
+	tp.Lock()
+	scheduled := tp.scheduled[pod.Metadata.Uid]
+	tp.Unlock()
+	if !scheduled {
+		t.Error("throttled pod is no longer scheduled for another attempt")
+	}
+}
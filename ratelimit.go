@@ -0,0 +1,206 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// limiterIdleTimeout is how long an unused bucket is kept. A bucket
+	// idle for that long has refilled, so dropping it changes nothing.
+	limiterIdleTimeout = 10 * time.Minute
+
+	// vaultCreateWait is how long a request waits for a free Vault create
+	// slot before it is turned away.
+	vaultCreateWait = 5 * time.Second
+
+	// busyRetryAfter is the delay suggested to callers turned away because
+	// the controller is busy.
+	busyRetryAfter = 5 * time.Second
+)
+
+var (
+	podLimiter       *keyedLimiter
+	namespaceLimiter *keyedLimiter
+	pushPool         *workerPool
+	vaultCreates     *semaphore
+)
+
+// retryAfterError tells the caller to try again later. handler sets the
+// Retry-After header from it.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// keyedLimiter keeps a token bucket per key, such as a pod UID.
+type keyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(b TokenBucket) *keyedLimiter {
+	per, _ := parseDuration(b.Per)
+	return &keyedLimiter{
+		limit:     rate.Limit(float64(b.Requests) / per.Seconds()),
+		burst:     b.Burst,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Reserve takes a token from the bucket for key at now. When the bucket is
+// empty it returns nil and how long until the next token is available. The
+// token can be handed back with CancelAt(now).
+func (l *keyedLimiter) Reserve(key string, now time.Time) (*rate.Reservation, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > limiterIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return nil, limiterIdleTimeout
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return nil, delay
+	}
+	return r, 0
+}
+
+// checkRateLimits takes a token from the buckets of the pod and its
+// namespace. A request turned away by the namespace gets the pod's token
+// back.
+func checkRateLimits(pod *Pod) error {
+	now := time.Now()
+	podToken, delay := podLimiter.Reserve(pod.Metadata.Uid, now)
+	if podToken == nil {
+		return &retryAfterError{
+			err:   fmt.Errorf("too many token requests for pod (%s)", pod.Metadata.Name),
+			after: delay,
+		}
+	}
+	if r, delay := namespaceLimiter.Reserve(pod.Metadata.Namespace, now); r == nil {
+		podToken.CancelAt(now)
+		return &retryAfterError{
+			err:   fmt.Errorf("too many token requests for namespace %s", pod.Metadata.Namespace),
+			after: delay,
+		}
+	}
+	return nil
+}
+
+// workerPool bounds the number of jobs running at once. A worker is
+// reserved before the work leading up to a job is done, so a busy pool
+// turns requests away before any token is created.
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(workers int) *workerPool {
+	return &workerPool{slots: make(chan struct{}, workers)}
+}
+
+// Reserve claims a worker and reports false when all of them are busy.
+func (p *workerPool) Reserve() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release returns a reserved worker that was not used.
+func (p *workerPool) Release() {
+	<-p.slots
+}
+
+// Go runs f on a reserved worker and frees it once f returns.
+func (p *workerPool) Go(f func()) {
+	go func() {
+		defer p.Release()
+		f()
+	}()
+}
+
+// semaphore bounds the number of concurrent calls.
+type semaphore struct {
+	slots chan struct{}
+}
+
+func newSemaphore(n int) *semaphore {
+	return &semaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire waits up to timeout for a slot and reports whether it got one.
+func (s *semaphore) Acquire(timeout time.Duration) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (s *semaphore) Release() {
+	<-s.slots
+}
+
+// setupRateLimits creates the limiters from the controller configuration.
+func setupRateLimits(config *Config) {
+	limits := config.RateLimits.withDefaults()
+	podLimiter = newKeyedLimiter(limits.Pod)
+	namespaceLimiter = newKeyedLimiter(limits.Namespace)
+	pushPool = newWorkerPool(limits.PushWorkers)
+	vaultCreates = newSemaphore(limits.MaxInFlightCreates)
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+)
+
+// reflector keeps a local copy of a Kubernetes collection in sync through
+// list and watch requests.
+type reflector struct {
+	client *kubernetesClient
+	name   string
+	path   string
+
+	// labelSelector limits the collection to matching objects.
+	labelSelector string
+
+	// replace is called with every item after a list.
+	replace func(items []json.RawMessage) error
+
+	// apply is called for every ADDED, MODIFIED and DELETED watch event.
+	apply func(eventType string, object json.RawMessage) error
+
+	// relist, when set, makes the reflector stop watching and list the
+	// collection again each time it receives a value.
+	relist <-chan struct{}
+}
+
+// errRelist is returned by watch when a relist was requested.
+var errRelist = errors.New("relist requested")
+
+// Run lists and watches the collection until done is closed.
+func (r *reflector) Run(done <-chan struct{}) {
+	retryDelay := 5 * time.Second
+	for {
+		resourceVersion, err := r.list()
+		if err != nil {
+			log.Printf("%s: list error %v; retrying in %v", r.name, err, retryDelay)
+			select {
+			case <-time.After(retryDelay):
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		for {
+			resourceVersion, err = r.watch(resourceVersion, done)
+			if err != nil {
+				break
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+		if err != errWatchExpired && err != errRelist {
+			log.Printf("%s: watch error %v; relisting in %v", r.name, err, retryDelay)
+			select {
+			case <-time.After(retryDelay):
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (r *reflector) list() (string, error) {
+	var list ObjectList
+	if err := r.client.do("GET", r.url(nil), nil, &list); err != nil {
+		return "", err
+	}
+	if err := r.replace(list.Items); err != nil {
+		return "", err
+	}
+	log.Printf("%s: synced %d objects at resource version %s", r.name, len(list.Items), list.Metadata.ResourceVersion)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// url returns the collection path with the query parameters and the label
+// selector.
+func (r *reflector) url(query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if r.labelSelector != "" {
+		query.Set("labelSelector", r.labelSelector)
+	}
+	if len(query) == 0 {
+		return r.path
+	}
+	return r.path + "?" + query.Encode()
+}
+
+// watch applies events until the server closes the watch and returns the
+// last resource version seen.
+func (r *reflector) watch(resourceVersion string, done <-chan struct{}) (string, error) {
+	body, err := r.client.stream(r.url(url.Values{
+		"watch":               {"1"},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+		"resourceVersion":     {resourceVersion},
+	}))
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer body.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	relisting := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			body.Close()
+		case <-r.relist:
+			close(relisting)
+			body.Close()
+		case <-stop:
+		}
+	}()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var event WatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			select {
+			case <-relisting:
+				log.Printf("%s: relisting", r.name)
+				return resourceVersion, errRelist
+			default:
+			}
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		if event.Type == "ERROR" {
+			var status APIStatus
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return resourceVersion, err
+			}
+			if status.Code == 410 {
+				return resourceVersion, errWatchExpired
+			}
+			return resourceVersion, fmt.Errorf("watch error: %s", status.Message)
+		}
+
+		var object struct {
+			Metadata Metadata `json:"metadata"`
+		}
+		if err := json.Unmarshal(event.Object, &object); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = object.Metadata.ResourceVersion
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			if err := r.apply(event.Type, event.Object); err != nil {
+				return resourceVersion, err
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// revokeRequestHandler revokes the tokens issued to the calling pod, for
+// use from a preStop hook. The pod is verified the same way as for a token
+// request. Revoking tokens that were already revoked succeeds.
+func revokeRequestHandler(w io.Writer, r *http.Request) (code int, err error) {
+	log.Printf("revoke request from %s", r.RemoteAddr)
+	entry := newAuditEntry(r)
+	defer func() {
+		entry.finish(code, err)
+		audit(entry)
+	}()
+
+	if r.Method != "POST" {
+		return 405, fmt.Errorf("revoke request from %s: method %s not allowed", r.RemoteAddr, r.Method)
+	}
+
+	pod, code, err := authorizePod(r, &entry)
+	if err != nil {
+		return code, err
+	}
+
+	revoked, err := revoker.RevokePod(pod.Metadata.Uid)
+	if err != nil {
+		log.Printf("error revoking tokens for pod (%s): %s", pod.Metadata.Name, err)
+		return 500, fmt.Errorf("error revoking tokens for pod (%s); revocation will be retried", pod.Metadata.Name)
+	}
+
+	entry.Decision = "revoke"
+	entry.Reason = fmt.Sprintf("revoked %d tokens at the pod's request", revoked)
+	if revoked > 0 {
+		recordEvent(pod, eventNormal, reasonTokenRevoked, fmt.Sprintf("Revoked %d Vault tokens at the pod's request", revoked))
+	}
+	return 200, nil
+}
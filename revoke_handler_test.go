@@ -0,0 +1,204 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeVault is a Vault that records the accessors it is asked to revoke.
+// Accessors listed in failing get a server error and those listed in
+// unknown an invalid accessor error.
+type fakeVault struct {
+	sync.Mutex
+	revoked []string
+	failing map[string]bool
+	unknown map[string]bool
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Accessor string `json:"accessor"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	v.Lock()
+	defer v.Unlock()
+	switch {
+	case r.URL.Path != "/v1/auth/token/revoke-accessor":
+		w.WriteHeader(404)
+	case v.failing[body.Accessor]:
+		w.WriteHeader(500)
+		w.Write([]byte(`{"errors": ["internal error"]}`))
+	case v.unknown[body.Accessor]:
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errors": ["1 error occurred:\n\t* invalid accessor\n\n"]}`))
+	default:
+		v.revoked = append(v.revoked, body.Accessor)
+		w.WriteHeader(204)
+	}
+}
+
+// takeRevoked returns the accessors revoked since the last call, sorted.
+func (v *fakeVault) takeRevoked() []string {
+	v.Lock()
+	defer v.Unlock()
+	revoked := v.revoked
+	v.revoked = nil
+	sort.Strings(revoked)
+	return revoked
+}
+
+// setupVaults points vaults at a single default backend served by handler
+// and returns a function restoring the previous backends.
+func setupVaults(t *testing.T, handler http.Handler) func() {
+	server := httptest.NewServer(handler)
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := vaults
+	vaults = &vaultBackends{
+		backends:    map[string]*vaultBackend{"default": {name: "default", address: server.URL, client: client}},
+		defaultName: "default",
+	}
+	return func() {
+		vaults = previous
+		server.Close()
+	}
+}
+
+func TestRevokeRequestHandler(t *testing.T) {
+	defer func(audiences []string) { tokenAudiences = audiences }(tokenAudiences)
+	tokenAudiences = []string{"vault-controller"}
+
+	_, done := fakeKubernetes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review TokenReview
+		json.NewDecoder(r.Body).Decode(&review)
+		review.Status = TokenReviewStatus{
+			Authenticated: true,
+			User: UserInfo{
+				Username: "system:serviceaccount:default:web",
+				Extra: map[string][]string{
+					podNameExtraKey: {"web-1"},
+					podUIDExtraKey:  {"1234"},
+				},
+			},
+			Audiences: []string{"vault-controller"},
+		}
+		json.NewEncoder(w).Encode(&review)
+	}))
+	defer done()
+
+	vault := &fakeVault{failing: map[string]bool{}, unknown: map[string]bool{"expired": true}}
+	defer setupVaults(t, vault)()
+
+	dir, err := ioutil.TempDir("", "revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := newFileLedger(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(l Ledger, tr *tokenRevoker, pc *podCache) {
+		ledger, revoker, podStore = l, tr, pc
+	}(ledger, revoker, podStore)
+	ledger = l
+	revoker = newTokenRevoker(l)
+	podStore = newPodCache(kubeClient)
+	podStore.update(&Pod{
+		Metadata: Metadata{
+			Namespace:   "default",
+			Name:        "web-1",
+			Uid:         "1234",
+			Annotations: map[string]string{"vaultproject.io/policies": "web"},
+		},
+		Spec:   PodSpec{ServiceAccountName: "web"},
+		Status: Status{PodIP: "10.1.2.3"},
+	})
+
+	revokedAt := time.Now().UTC()
+	for _, r := range []*IssuanceRecord{
+		{PodUID: "1234", Namespace: "default", Name: "web-1", Accessor: "pod"},
+		{PodUID: "1234", Namespace: "default", Name: "web-1", Accessor: "secrets"},
+		{PodUID: "1234", Namespace: "default", Name: "web-1", Accessor: "expired"},
+		{PodUID: "1234", Namespace: "default", Name: "web-1", Accessor: "old", RevokeTime: &revokedAt},
+		{PodUID: "5678", Namespace: "default", Name: "web-2", Accessor: "other"},
+	} {
+		if err := ledger.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The steps share the ledger and run in order.
+	tests := []struct {
+		name        string
+		method      string
+		remoteAddr  string
+		failing     string
+		wantCode    int
+		wantRevoked []string
+		wantQueued  int
+	}{
+		{name: "wrong method", method: "GET", remoteAddr: "10.1.2.3:4567", wantCode: 405},
+		{name: "other source", method: "POST", remoteAddr: "10.9.9.9:4567", wantCode: 403},
+		{name: "vault error", method: "POST", remoteAddr: "10.1.2.3:4567", failing: "secrets", wantCode: 500, wantRevoked: []string{"pod"}, wantQueued: 1},
+		{name: "retried", method: "POST", remoteAddr: "10.1.2.3:4567", wantCode: 200, wantRevoked: []string{"secrets"}},
+		{name: "already revoked", method: "POST", remoteAddr: "10.1.2.3:4567", wantCode: 200},
+	}
+	for _, tt := range tests {
+		vault.Lock()
+		vault.failing = map[string]bool{tt.failing: true}
+		vault.Unlock()
+
+		r := httptest.NewRequest(tt.method, "/revoke?name=web-1&namespace=default", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("Authorization", "Bearer token")
+		code, err := revokeRequestHandler(ioutil.Discard, r)
+		if code != tt.wantCode {
+			t.Errorf("%s: revokeRequestHandler() = %d, %v; want %d", tt.name, code, err, tt.wantCode)
+		}
+		if got := vault.takeRevoked(); !reflect.DeepEqual(got, tt.wantRevoked) {
+			t.Errorf("%s: revoked %v, want %v", tt.name, got, tt.wantRevoked)
+		}
+		if queued := len(revoker.queue); queued != tt.wantQueued {
+			t.Errorf("%s: %d revocations queued, want %d", tt.name, queued, tt.wantQueued)
+		}
+		for len(revoker.queue) > 0 {
+			<-revoker.queue
+		}
+	}
+
+	for _, accessor := range []string{"pod", "secrets", "expired"} {
+		if r, _ := ledger.Get(accessor); r == nil || r.RevokeTime == nil {
+			t.Errorf("token %s not recorded as revoked: %+v", accessor, r)
+		}
+	}
+	if r, _ := ledger.Get("other"); r == nil || r.RevokeTime != nil {
+		t.Errorf("token of another pod recorded as revoked: %+v", r)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	minRevokeRetryDelay = 5 * time.Second
+	maxRevokeRetryDelay = 5 * time.Minute
+
+	reconcileInterval = 10 * time.Minute
+	revokedRetention  = 24 * time.Hour
+
+	// unconfirmedGracePeriod allows for a delivery that completed just
+	// before the wrapping token expired but was not yet recorded.
+	unconfirmedGracePeriod = time.Minute
+)
+
+type revocation struct {
+	vault     string
+	namespace string
+	podUID    string
+	pod       string
+	accessor  string
+	attempt   int
+}
+
+// tokenRevoker revokes the tokens recorded in the ledger once the pod they
+// were issued to is deleted or has terminated.
+type tokenRevoker struct {
+	ledger Ledger
+	queue  chan revocation
+}
+
+func newTokenRevoker(ledger Ledger) *tokenRevoker {
+	return &tokenRevoker{
+		ledger: ledger,
+		queue:  make(chan revocation, 1024),
+	}
+}
+
+// HandlePodEvent queues the pod's tokens for revocation when the pod is gone
+// or will not run again. It runs on the pod watch, so it only reads the
+// in-memory ledger index and never blocks; pods without a Vault grant have
+// no records and cost a map lookup.
+func (tr *tokenRevoker) HandlePodEvent(eventType string, pod *Pod) {
+	if !elector.IsLeader() {
+		return
+	}
+	if eventType != "DELETED" && !podTerminated(pod) {
+		return
+	}
+
+	records, err := tr.ledger.ByPod(pod.Metadata.Uid)
+	if err != nil {
+		log.Printf("token revoker: error reading ledger for pod %s: %v", pod.Metadata.Uid, err)
+		return
+	}
+	for _, r := range records {
+		if r.RevokeTime != nil {
+			continue
+		}
+		log.Printf("token revoker: pod %s (%s) is %s; revoking token", podKey(r.Namespace, r.Name), r.PodUID, podState(eventType, pod))
+		tr.enqueue(r)
+	}
+}
+
+func podTerminated(pod *Pod) bool {
+	return pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed"
+}
+
+func podState(eventType string, pod *Pod) string {
+	if eventType == "DELETED" {
+		return "deleted"
+	}
+	return strings.ToLower(pod.Status.Phase)
+}
+
+// Revoke queues the token with the given accessor for revocation.
+func (tr *tokenRevoker) Revoke(accessor string) {
+	r, err := tr.ledger.Get(accessor)
+	if err != nil || r == nil {
+		log.Printf("token revoker: no ledger record for accessor %s: %v", accessor, err)
+		return
+	}
+	tr.enqueue(r)
+}
+
+func (tr *tokenRevoker) enqueue(r *IssuanceRecord) {
+	tr.push(newRevocation(r))
+}
+
+// push queues the revocation without blocking. When the queue is full the
+// revocation is dropped; the token stays unrevoked in the ledger, so the
+// next reconcile picks it up again.
+func (tr *tokenRevoker) push(r revocation) {
+	select {
+	case tr.queue <- r:
+	default:
+		log.Printf("token revoker: queue full; revocation of token for pod %s (%s) left to the next reconcile", r.pod, r.podUID)
+	}
+}
+
+func newRevocation(r *IssuanceRecord) revocation {
+	return revocation{vault: r.Vault, namespace: r.VaultNamespace, podUID: r.PodUID, pod: podKey(r.Namespace, r.Name), accessor: r.Accessor}
+}
+
+// Run revokes queued tokens until done is closed. Failed revocations are
+// retried with an exponential backoff. The leader also reconciles the ledger
+// against the cluster on start and periodically after that, which catches
+// pods deleted while no controller was running.
+func (tr *tokenRevoker) Run(done <-chan struct{}) {
+	reconcile := time.After(time.Minute)
+	for {
+		select {
+		case r := <-tr.queue:
+			tr.revoke(r)
+		case <-reconcile:
+			if elector.IsLeader() {
+				go tr.Reconcile()
+			}
+			reconcile = time.After(reconcileInterval)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (tr *tokenRevoker) revoke(r revocation) {
+	err := tr.revokeNow(r)
+	if err == nil || err == errUnknownVault {
+		return
+	}
+	delay := revokeRetryDelay(r.attempt)
+	r.attempt++
+	log.Printf("token revoker: error revoking token for pod %s (%s): %v; retrying in %v", r.pod, r.podUID, err, delay)
+	time.AfterFunc(delay, func() {
+		tr.push(r)
+	})
+}
+
+// revokeRetryDelay returns how long to wait before retrying a revocation
+// that failed attempt times before, doubling up to maxRevokeRetryDelay.
+func revokeRetryDelay(attempt int) time.Duration {
+	delay := minRevokeRetryDelay << uint(attempt)
+	if delay > maxRevokeRetryDelay || delay <= 0 {
+		delay = maxRevokeRetryDelay
+	}
+	return delay
+}
+
+var errUnknownVault = errors.New("unknown vault")
+
+// revokeNow revokes the token and marks it revoked in the ledger. Tokens
+// that already expired or were revoked count as revoked.
+func (tr *tokenRevoker) revokeNow(r revocation) error {
+	// Records written before multiple backends were supported name no
+	// vault and belong to the default one.
+	vault, err := vaults.Get(r.vault)
+	if err != nil {
+		log.Printf("token revoker: cannot revoke token for pod %s (%s): %v", r.pod, r.podUID, err)
+		return errUnknownVault
+	}
+	err = vault.revokeAccessor(r.namespace, r.accessor)
+	switch {
+	case err == nil:
+		log.Printf("token revoker: revoked token for pod %s (%s)", r.pod, r.podUID)
+	case isInvalidAccessor(err):
+		log.Printf("token revoker: token for pod %s (%s) already expired or revoked", r.pod, r.podUID)
+	default:
+		return err
+	}
+
+	if err := tr.markRevoked(r.accessor); err != nil {
+		log.Printf("token revoker: error updating ledger for pod %s (%s): %v", r.pod, r.podUID, err)
+	}
+	return nil
+}
+
+// RevokePod revokes every token issued to the pod with the given UID and
+// returns how many were revoked. Tokens that could not be revoked are
+// queued for another attempt. Revoking the tokens of a pod twice is safe.
+func (tr *tokenRevoker) RevokePod(podUID string) (int, error) {
+	records, err := tr.ledger.ByPod(podUID)
+	if err != nil {
+		return 0, err
+	}
+	var revoked int
+	var lastErr error
+	for _, r := range records {
+		if r.RevokeTime != nil {
+			continue
+		}
+		rev := newRevocation(r)
+		if err := tr.revokeNow(rev); err != nil {
+			lastErr = err
+			if err != errUnknownVault {
+				tr.push(rev)
+			}
+			continue
+		}
+		revoked++
+	}
+	return revoked, lastErr
+}
+
+func (tr *tokenRevoker) markRevoked(accessor string) error {
+	now := time.Now().UTC()
+	err := tr.ledger.Update(accessor, func(r *IssuanceRecord) {
+		r.RevokeTime = &now
+	})
+	if err == errRecordNotFound {
+		return nil
+	}
+	return err
+}
+
+// Reconcile revokes tokens held by pods that no longer exist or that were
+// never confirmed by the pod, and drops records that were revoked long ago.
+func (tr *tokenRevoker) Reconcile() {
+	records, err := tr.ledger.List()
+	if err != nil {
+		log.Printf("token revoker: error reading ledger: %v", err)
+		return
+	}
+
+	for _, r := range records {
+		if r.RevokeTime != nil {
+			if time.Since(*r.RevokeTime) > revokedRetention {
+				if err := tr.ledger.Delete(r.Accessor); err != nil {
+					log.Printf("token revoker: error removing ledger record for pod %s: %v", r.PodUID, err)
+				}
+			}
+			continue
+		}
+
+		// A token the pod never confirmed receiving is of no use to it,
+		// and may be held by someone else.
+		unconfirmed := r.Delivery == deliveryPending || r.Delivery == deliveryFailed
+		if unconfirmed && r.WrapExpiry != nil && time.Since(*r.WrapExpiry) > unconfirmedGracePeriod {
+			log.Printf("token revoker: token for pod %s (%s) was never confirmed by the pod; revoking", podKey(r.Namespace, r.Name), r.PodUID)
+			tr.enqueue(r)
+			continue
+		}
+
+		pod, err := podStore.Lookup(r.Namespace, r.Name, r.PodUID)
+		if err != nil && !isNotFound(err) {
+			log.Printf("token revoker: error looking up pod %s: %v", podKey(r.Namespace, r.Name), err)
+			continue
+		}
+		if err == nil && pod.Metadata.Uid == r.PodUID && !podTerminated(pod) {
+			continue
+		}
+		log.Printf("token revoker: pod %s (%s) no longer running; revoking token", podKey(r.Namespace, r.Name), r.PodUID)
+		tr.enqueue(r)
+	}
+}
+
+// isInvalidAccessor reports whether Vault rejected the accessor because the
+// token no longer exists.
+func isInvalidAccessor(err error) bool {
+	e, ok := err.(*api.ResponseError)
+	if !ok || e.StatusCode != 400 {
+		return false
+	}
+	for _, msg := range e.Errors {
+		if strings.Contains(msg, "invalid accessor") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLedger returns a file ledger in a temporary directory removed
+// when the test ends.
+func newTestLedger(t *testing.T) *fileLedger {
+	dir, err := ioutil.TempDir("", "revoker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := newFileLedger(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// queued drains the revocation queue and returns the accessors in it,
+// sorted.
+func queued(tr *tokenRevoker) []string {
+	var accessors []string
+	for len(tr.queue) > 0 {
+		accessors = append(accessors, (<-tr.queue).accessor)
+	}
+	sort.Strings(accessors)
+	return accessors
+}
+
+func TestTokenRevokerRevoke(t *testing.T) {
+	vault := &fakeVault{
+		failing: map[string]bool{"failing": true},
+		unknown: map[string]bool{"expired": true},
+	}
+	defer setupVaults(t, vault)()
+	tr := newTokenRevoker(newTestLedger(t))
+
+	tests := []struct {
+		accessor    string
+		vault       string
+		wantErr     bool
+		wantRevoked bool
+	}{
+		{accessor: "live", wantRevoked: true},
+		{accessor: "expired", wantRevoked: true},
+		{accessor: "failing", wantErr: true},
+		{accessor: "elsewhere", vault: "other", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := &IssuanceRecord{PodUID: "1", Namespace: "default", Name: "web", Accessor: tt.accessor, Vault: tt.vault}
+		if err := tr.ledger.Put(r); err != nil {
+			t.Fatal(err)
+		}
+		err := tr.revokeNow(newRevocation(r))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: revokeNow() = %v, want error %v", tt.accessor, err, tt.wantErr)
+		}
+		got, _ := tr.ledger.Get(tt.accessor)
+		if revoked := got.RevokeTime != nil; revoked != tt.wantRevoked {
+			t.Errorf("%s: recorded as revoked = %v, want %v", tt.accessor, revoked, tt.wantRevoked)
+		}
+	}
+	vault.takeRevoked()
+
+	// A failed revocation is retried later with a growing delay, and one
+	// for a Vault that is not configured is not retried at all.
+	tr.revoke(revocation{vault: "other", accessor: "elsewhere"})
+	tr.revoke(revocation{accessor: "failing"})
+	if got := queued(tr); len(got) != 0 {
+		t.Errorf("revocations %v requeued without a delay", got)
+	}
+	delays := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}
+	for attempt, want := range delays {
+		if got := revokeRetryDelay(attempt); got != want {
+			t.Errorf("revokeRetryDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	for _, attempt := range []int{7, 8, 64, 100} {
+		if got := revokeRetryDelay(attempt); got != maxRevokeRetryDelay {
+			t.Errorf("revokeRetryDelay(%d) = %v, want %v", attempt, got, maxRevokeRetryDelay)
+		}
+	}
+}
+
+func TestTokenRevokerHandlePodEvent(t *testing.T) {
+	tr := newTokenRevoker(newTestLedger(t))
+	revokedAt := time.Now().UTC()
+	for _, r := range []*IssuanceRecord{
+		{PodUID: "1", Accessor: "pod"},
+		{PodUID: "1", Accessor: "secrets"},
+		{PodUID: "1", Accessor: "revoked", RevokeTime: &revokedAt},
+		{PodUID: "2", Accessor: "other"},
+	} {
+		if err := tr.ledger.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		eventType string
+		phase     string
+		want      []string
+	}{
+		{eventType: "MODIFIED", phase: "Running"},
+		{eventType: "MODIFIED", phase: "Succeeded", want: []string{"pod", "secrets"}},
+		{eventType: "MODIFIED", phase: "Failed", want: []string{"pod", "secrets"}},
+		{eventType: "DELETED", phase: "Running", want: []string{"pod", "secrets"}},
+	}
+	for _, tt := range tests {
+		pod := &Pod{Metadata: Metadata{Uid: "1"}, Status: Status{Phase: tt.phase}}
+		tr.HandlePodEvent(tt.eventType, pod)
+		if got := queued(tr); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: queued %v, want %v", tt.eventType, tt.phase, got, tt.want)
+		}
+	}
+}
+
+func TestTokenRevokerReconcile(t *testing.T) {
+	pods := map[string]*Pod{
+		"running":   {Metadata: Metadata{Namespace: "default", Name: "running", Uid: "running"}, Status: Status{Phase: "Running"}},
+		"recreated": {Metadata: Metadata{Namespace: "default", Name: "recreated", Uid: "new"}, Status: Status{Phase: "Running"}},
+		"succeeded": {Metadata: Metadata{Namespace: "default", Name: "succeeded", Uid: "succeeded"}, Status: Status{Phase: "Succeeded"}},
+	}
+	_, done := fakeKubernetes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if name == "unreachable" {
+			w.WriteHeader(500)
+			return
+		}
+		pod, ok := pods[name]
+		if !ok {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(APIStatus{Kind: "Status", Reason: "NotFound"})
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	}))
+	defer done()
+	defer func(pc *podCache) { podStore = pc }(podStore)
+	podStore = newPodCache(kubeClient)
+
+	tr := newTokenRevoker(newTestLedger(t))
+	now := time.Now().UTC()
+	longAgo := now.Add(-revokedRetention - time.Hour)
+	expired := now.Add(-unconfirmedGracePeriod - time.Minute)
+	fresh := now.Add(time.Minute)
+	records := []*IssuanceRecord{
+		{Name: "running", PodUID: "running", Accessor: "running", Delivery: deliveryDelivered},
+		{Name: "running", PodUID: "running", Accessor: "unwrapping", Delivery: deliveryPending, WrapExpiry: &fresh},
+		{Name: "running", PodUID: "running", Accessor: "never confirmed", Delivery: deliveryPending, WrapExpiry: &expired},
+		{Name: "running", PodUID: "running", Accessor: "push failed", Delivery: deliveryFailed, WrapExpiry: &expired},
+		{Name: "recreated", PodUID: "old", Accessor: "recreated", Delivery: deliveryDelivered},
+		{Name: "succeeded", PodUID: "succeeded", Accessor: "succeeded", Delivery: deliveryDelivered},
+		{Name: "deleted", PodUID: "deleted", Accessor: "deleted", Delivery: deliveryDelivered},
+		{Name: "unreachable", PodUID: "unreachable", Accessor: "unreachable", Delivery: deliveryDelivered},
+		{Name: "deleted", PodUID: "deleted", Accessor: "revoked", RevokeTime: &now},
+		{Name: "deleted", PodUID: "deleted", Accessor: "revoked long ago", RevokeTime: &longAgo},
+	}
+	for _, r := range records {
+		r.Namespace = "default"
+		if err := tr.ledger.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr.Reconcile()
+	want := []string{"deleted", "never confirmed", "push failed", "recreated", "succeeded"}
+	if got := queued(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("Reconcile() queued %v, want %v", got, want)
+	}
+	if r, _ := tr.ledger.Get("revoked long ago"); r != nil {
+		t.Errorf("record revoked long ago still in the ledger: %+v", r)
+	}
+	if r, _ := tr.ledger.Get("revoked"); r == nil {
+		t.Error("recently revoked record dropped from the ledger")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// tokenFileName is the file vault-init writes the unwrapped token to. No
+// secret may be written over it.
+const tokenFileName = "secret.json"
+
+// wrappedSecret is a secret read with response wrapping on behalf of a pod.
+type wrappedSecret struct {
+	Path string `json:"path"`
+	*api.SecretWrapInfo
+}
+
+// parseSecretPaths splits the vaultproject.io/secrets annotation.
+func parseSecretPaths(annotation string) []string {
+	var paths []string
+	for _, p := range strings.Split(annotation, ",") {
+		p = strings.Trim(strings.TrimSpace(p), "/")
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// secretFileName returns the name of the file vault-init writes the secret
+// at path to, such as database_creds_app.json for database/creds/app.
+func secretFileName(path string) string {
+	return strings.Replace(path, "/", "_", -1) + ".json"
+}
+
+// validateSecretPaths checks that every path can be written to a file of
+// its own next to the token.
+func validateSecretPaths(paths []string) error {
+	files := make(map[string]string)
+	for _, p := range paths {
+		for _, segment := range strings.Split(p, "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return fmt.Errorf("invalid secret path %q", p)
+			}
+		}
+		name := secretFileName(p)
+		if name == tokenFileName {
+			return fmt.Errorf("secret path %q conflicts with the token file", p)
+		}
+		if other, ok := files[name]; ok {
+			return fmt.Errorf("secret paths %q and %q are written to the same file", other, p)
+		}
+		files[name] = p
+	}
+	return nil
+}
+
+// issueSecrets reads the secrets requested by the pod with response
+// wrapping. The reads are made with a token of their own carrying the pod's
+// policies, so the pod can only receive secrets it could read itself. Leases
+// of dynamic secrets belong to that token: it is not delivered to the pod,
+// but it is recorded in the ledger and revoked with the pod token.
+func issueSecrets(pod *Pod, vault *vaultBackend, namespace string, tcr *api.TokenCreateRequest, role string, paths []string, wrapTTL string, expiry time.Time) ([]wrappedSecret, string, int, error) {
+	name := pod.Metadata.Name
+
+	// The token must outlive the leases it holds, so it is neither use
+	// limited nor periodic.
+	renewable := false
+	str := *tcr
+	str.Metadata = make(map[string]string, len(tcr.Metadata)+1)
+	for k, v := range tcr.Metadata {
+		str.Metadata[k] = v
+	}
+	str.Metadata["purpose"] = "secrets"
+	str.NumUses = 0
+	str.Period = ""
+	str.Renewable = &renewable
+
+	secret, err := vault.createToken(namespace, &str, role)
+	if err != nil {
+		log.Printf("error creating secrets token for pod (%s): %s", name, err)
+		recordEvent(pod, eventWarning, reasonTokenCreateFailed, fmt.Sprintf("Error creating Vault token for secrets: %s", err))
+		return nil, "", 500, fmt.Errorf("error creating secrets token for pod (%s)", name)
+	}
+	if secret.Auth == nil {
+		return nil, "", 500, fmt.Errorf("error parsing secrets token for pod (%s)", name)
+	}
+
+	accessor := secret.Auth.Accessor
+	ttl, _ := parseDuration(str.TTL)
+	err = ledger.Put(&IssuanceRecord{
+		PodUID:    pod.Metadata.Uid,
+		Namespace: pod.Metadata.Namespace,
+		Name:      pod.Metadata.Name,
+		Accessor:  accessor,
+		Policies:  str.Policies,
+		Role:      role,
+		TTL:       ttl.String(),
+		IssueTime: time.Now().UTC(),
+		Delivery:  deliveryPending,
+		Vault:     vault.name,
+		Secrets:   paths,
+
+		VaultNamespace: namespace,
+
+		WrapExpiry: &expiry,
+	})
+	if err != nil {
+		if err := vault.revokeAccessor(namespace, accessor); err != nil {
+			log.Printf("error revoking untracked secrets token for pod (%s): %s", name, err)
+		}
+		recordEvent(pod, eventWarning, reasonTokenCreateFailed, "Error recording the Vault token in the issuance ledger")
+		return nil, "", 500, fmt.Errorf("error recording secrets token for pod (%s): %s", name, err)
+	}
+
+	var secrets []wrappedSecret
+	for _, p := range paths {
+		wrapInfo, err := vault.readWrapped(namespace, secret.Auth.ClientToken, p, wrapTTL)
+		if err != nil {
+			revoker.Revoke(accessor)
+			log.Printf("error reading secret %s for pod (%s): %s", p, name, err)
+			recordEvent(pod, eventWarning, reasonSecretReadFailed, fmt.Sprintf("Error reading Vault secret %s: %s", p, err))
+			if e, ok := err.(*api.ResponseError); ok && (e.StatusCode == 403 || e.StatusCode == 404) {
+				return nil, "", 403, fmt.Errorf("error reading secret %s for pod (%s): %s", p, name, err)
+			}
+			return nil, "", 500, fmt.Errorf("error reading secret %s for pod (%s)", p, name)
+		}
+		secrets = append(secrets, wrappedSecret{Path: p, SecretWrapInfo: wrapInfo})
+	}
+	return secrets, accessor, 200, nil
+}
@@ -14,21 +14,74 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
-
-	"github.com/hashicorp/vault/api"
+	"time"
 )
 
-func tokenRequestHandler(w io.Writer, r *http.Request) (int, error) {
+func tokenRequestHandler(w io.Writer, r *http.Request) (code int, err error) {
 	log.Printf("token request from %s", r.RemoteAddr)
+	entry := newAuditEntry(r)
+	defer func() {
+		entry.finish(code, err)
+		audit(entry)
+		tokenRequests.WithLabelValues(requestNamespaceLabel(&entry), entry.Decision, strconv.Itoa(code)).Inc()
+	}()
+
+	if pushMode {
+		// Tokens are pushed to annotated pods as soon as they are
+		// scheduled, the request itself is not trusted for anything.
+		entry.Decision = "ignore"
+		entry.Reason = "push mode"
+		return 202, nil
+	}
+
+	pod, code, err := authorizePod(r, &entry)
+	if err != nil {
+		return code, err
+	}
+
+	if err := checkRateLimits(pod); err != nil {
+		return 429, err
+	}
+	// The push worker is claimed up front so no token is created that
+	// cannot be delivered.
+	if !pushPool.Reserve() {
+		return 503, &retryAfterError{
+			err:   fmt.Errorf("too many token pushes in progress; rejecting token request for pod (%s)", pod.Metadata.Name),
+			after: busyRetryAfter,
+		}
+	}
+
+	token, code, err := issueToken(pod, &entry)
+	if err != nil {
+		pushPool.Release()
+		return code, err
+	}
+
+	pushPool.Go(func() {
+		if err := pushWrappedTokenTo(pod, token); err != nil && err != errTokenIntercepted {
+			recordEvent(pod, eventWarning, reasonTokenPushFailed, fmt.Sprintf("Error pushing wrapped token to vault-init: %s", err))
+		}
+	})
+
+	return 202, nil
+}
+
+// authorizePod returns the pod named by the request after verifying the
+// request was made by that pod, recording what it learns in the audit
+// entry. The returned status code is meant to be returned to the caller when
+// err is not nil.
+func authorizePod(r *http.Request, entry *auditEntry) (*Pod, int, error) {
 	name := r.FormValue("name")
 	if name == "" {
-		return 400, fmt.Errorf("missing or empty name parameter from %s", r.RemoteAddr)
+		return nil, 400, fmt.Errorf("missing or empty name parameter from %s", r.RemoteAddr)
 	}
 
 	namespace := r.FormValue("namespace")
@@ -36,76 +89,198 @@ func tokenRequestHandler(w io.Writer, r *http.Request) (int, error) {
 		log.Println("token request: namespace missing or empty using default")
 		namespace = "default"
 	}
+	entry.Namespace = namespace
+	entry.Name = name
 
-	// Use kubectl proxy to lookup the pod details by name
-	u := fmt.Sprintf("http://127.0.0.1:8001/api/v1/namespaces/%s/pods/%s", namespace, name)
-	resp, err := http.Get(u)
+	// The caller must prove its identity with a service account token
+	// before the pod is looked up.
+	identity, code, err := authenticateRequest(r)
 	if err != nil {
-		return 500, fmt.Errorf("error during pod (%s) lookup %s", name, err)
+		entry.Decision = "deny"
+		entry.Reason = err.Error()
+		return nil, code, fmt.Errorf("token request for pod (%s): %s", name, err)
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return 500, fmt.Errorf("error parsing pod (%s) details: %s", name, err)
+	entry.ServiceAccount = identity.Username
+	if identity.Namespace != namespace {
+		entry.Decision = "deny"
+		entry.Reason = "service account namespace does not match pod namespace"
+		return nil, 403, fmt.Errorf("token request for pod (%s) from service account %s does not match namespace %s", name, identity.Username, namespace)
 	}
 
-	var pod Pod
-	err = json.Unmarshal(data, &pod)
+	lookupStart := time.Now()
+	pod, err := podStore.Lookup(namespace, name, identity.PodUID)
+	// The namespace has been checked against the caller's service account.
+	observeSince(podLookupDuration.WithLabelValues(metricsNamespaces.label(namespace)), lookupStart)
 	if err != nil {
-		return 500, fmt.Errorf("error parsing pod (%s) details: %s", name, err)
+		if e, ok := err.(*apiError); ok && (e.Code == 403 || e.Code == 404) {
+			return nil, e.Code, fmt.Errorf("error during pod (%s) lookup: %s", name, err)
+		}
+		return nil, 500, fmt.Errorf("error during pod (%s) lookup: %s", name, err)
+	}
+	entry.PodUID = pod.Metadata.Uid
+	entry.PodIP = pod.Status.PodIP
+
+	if err := identity.verifyPod(pod); err != nil {
+		entry.Decision = "deny"
+		entry.Reason = err.Error()
+		recordEvent(pod, eventWarning, reasonTokenRequestDenied, fmt.Sprintf("Token request denied: %s", err))
+		return nil, 403, fmt.Errorf("token request for pod (%s): %s", name, err)
 	}
 
 	if pod.Status.PodIP == "" {
-		return 412, fmt.Errorf("error missing or empty pod IP (%s)", name)
+		recordEvent(pod, eventWarning, reasonPodIPMissing, "Token request received before the pod was assigned an IP")
+		return nil, 412, fmt.Errorf("error missing or empty pod IP (%s)", name)
 	}
 
-	policies := pod.Metadata.Annotations["vaultproject.io/policies"]
-	if policies == "" {
-		return 500, fmt.Errorf("error missing or empty pod vaultproject.io/role annotation (%s)", name)
+	// The wrapped token is pushed to the pod IP, but only the pod itself
+	// is allowed to ask for it.
+	sourceIP, err := requestSourceIP(r)
+	if err != nil {
+		return nil, 400, fmt.Errorf("error parsing source address for pod (%s): %s", name, err)
 	}
-	ttl := pod.Metadata.Annotations["vaultproject.io/ttl"]
-	if ttl == "" {
-		ttl = "72h"
+	entry.SourceIP = sourceIP
+	if !sameIP(sourceIP, pod.Status.PodIP) {
+		entry.Decision = "deny"
+		entry.Reason = "source IP does not match pod IP"
+		recordEvent(pod, eventWarning, reasonTokenRequestDenied, fmt.Sprintf("Token request from %s does not match the pod IP", sourceIP))
+		return nil, 403, fmt.Errorf("token request for pod (%s) from %s does not match the pod IP", name, sourceIP)
 	}
+	return pod, 200, nil
+}
 
-	tcr := &api.TokenCreateRequest{
-		Policies: strings.Split(policies, ","),
-		Metadata: map[string]string{
-			"host_ip":   pod.Status.HostIP,
-			"namespace": pod.Metadata.Namespace,
-			"pod_ip":    pod.Status.PodIP,
-			"pod_name":  pod.Metadata.Name,
-			"pod_uid":   pod.Metadata.Uid,
-		},
-		DisplayName: pod.Metadata.Name,
-		Period:      ttl,
-		NoParent:    true,
-		TTL:         ttl,
-	}
-	secret, err := vaultClient.Auth().Token().Create(tcr)
+// requestSourceIP returns the IP address the token request originated from.
+// The forwarded header is only honoured when the request arrives from one of
+// the trusted proxies; the last entry is the one added by that proxy.
+func requestSourceIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return 500, fmt.Errorf("error creating wrapped token for pod (%s)", name)
+		return "", err
+	}
+	if forwardedHeader == "" || !isTrustedProxy(net.ParseIP(host)) {
+		return host, nil
 	}
 
-	var wrappedToken bytes.Buffer
-	err = json.NewEncoder(&wrappedToken).Encode(&secret.WrapInfo)
-	if err != nil {
-		return 500, fmt.Errorf("error parsing wrapped token for pod (%s)", name)
+	value := r.Header.Get(forwardedHeader)
+	if value == "" {
+		return host, nil
 	}
-	go pushWrappedTokenTo(pod.Status.PodIP, &wrappedToken)
+	addrs := strings.Split(value, ",")
+	ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+	if ip == nil {
+		return "", fmt.Errorf("invalid %s header %q", forwardedHeader, value)
+	}
+	return ip.String(), nil
+}
 
-	return 202, nil
+// sameIP reports whether a and b are the same IP address, however they are
+// spelled. Addresses that do not parse never match.
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipB != nil && ipA.Equal(ipB)
 }
 
-func pushWrappedTokenTo(ip string, token io.Reader) {
-	url := fmt.Sprintf("http://%s", ip)
-	resp, err := http.Post(url, "", token)
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errTokenIntercepted is returned when the wrapping token was unwrapped by
+// someone other than the pod. The token has been revoked.
+var errTokenIntercepted = errors.New("wrapping token was unwrapped before it reached the pod")
+
+// pushTimeout bounds a push to vault-init, which unwraps the token before it
+// answers. A pod that never answers would otherwise hold a push worker for
+// good.
+const pushTimeout = 15 * time.Second
+
+var pushClient = &http.Client{Timeout: pushTimeout}
+
+// pushWrappedTokenTo delivers the wrapped token to the vault-init container
+// listening on the pod IP. A nil error means the pod has either accepted the
+// token or already holds one.
+func pushWrappedTokenTo(pod *Pod, token *wrappedToken) (err error) {
+	url := fmt.Sprintf("http://%s", pod.Status.PodIP)
+	delivery := deliveryFailed
+	start := time.Now()
+	defer func() {
+		// A failed push is only harmless if the wrapping token is still
+		// unused; otherwise someone else holds the token.
+		if err != nil && err != errTokenIntercepted && time.Now().Before(wrapExpiry(token.SecretWrapInfo)) {
+			consumed, lookupErr := token.vault.wrappingTokenConsumed(token.VaultNamespace, token.Accessor)
+			if lookupErr != nil {
+				log.Printf("error looking up wrapping token for %s: %s", url, lookupErr)
+			} else if consumed {
+				delivery = deliveryIntercepted
+				tokenIntercepted(pod, token, "the wrapping token was unwrapped but the pod never confirmed it")
+				err = errTokenIntercepted
+			}
+		}
+		namespace := metricsNamespaces.label(pod.Metadata.Namespace)
+		tokenPushes.WithLabelValues(namespace, delivery).Inc()
+		observeSince(tokenPushDuration.WithLabelValues(namespace, delivery), start)
+		for _, a := range token.accessors() {
+			if setErr := setDelivery(ledger, a, delivery); setErr != nil {
+				log.Printf("error recording delivery to %s: %s", url, setErr)
+			}
+		}
+	}()
+
+	var body bytes.Buffer
+	err = json.NewEncoder(&body).Encode(token)
+	if err != nil {
+		log.Printf("error encoding wrapped token for %s: %s", url, err)
+		return err
+	}
+
+	resp, err := pushClient.Post(url, "", &body)
 	if err != nil {
 		log.Printf("error pushing wrapped token to %s: %s", url, err)
-		return
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		// The pod already holds a token so this one will never be used.
+		delivery = deliveryRejected
+		token.revoke()
+		log.Printf("wrapped token rejected by %s: %s", url, resp.Status)
+		recordEvent(pod, eventNormal, reasonTokenRejected, "vault-init already holds a token; the new token was revoked")
+		return nil
+	}
+	if resp.StatusCode == http.StatusGone && time.Now().Before(wrapExpiry(token.SecretWrapInfo)) {
+		// vault-init found the wrapping token already unwrapped.
+		delivery = deliveryIntercepted
+		tokenIntercepted(pod, token, "vault-init reported the wrapping token was already unwrapped")
+		return errTokenIntercepted
 	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("error pushing wrapped token to %s: %s", url, resp.Status)
-		return
+		return fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
 	}
+	delivery = deliveryDelivered
 	log.Printf("successfully pushed wrapped token to %s", url)
+	recordEvent(pod, eventNormal, reasonTokenPushed, "Wrapped token delivered to vault-init")
+	return nil
+}
+
+// tokenIntercepted revokes a token whose wrapping token was unwrapped by
+// someone other than the pod and raises an alert.
+func tokenIntercepted(pod *Pod, token *wrappedToken, reason string) {
+	log.Printf("alert: token for pod %s intercepted: %s; revoking", podKey(pod.Metadata.Namespace, pod.Metadata.Name), reason)
+	token.revoke()
+	audit(auditEntry{
+		Namespace: pod.Metadata.Namespace,
+		Name:      pod.Metadata.Name,
+		PodUID:    pod.Metadata.Uid,
+		PodIP:     pod.Status.PodIP,
+		Decision:  "alert",
+		Reason:    "token intercepted: " + reason,
+	})
+	recordEvent(pod, eventWarning, reasonTokenIntercepted, fmt.Sprintf("Possible token interception, %s; the token was revoked", reason))
 }
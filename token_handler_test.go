@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestSourceIP(t *testing.T) {
+	defer func(header string, proxies []*net.IPNet) {
+		forwardedHeader, trustedProxies = header, proxies
+	}(forwardedHeader, trustedProxies)
+
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/24", "fd00::/64"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		forwarded  string
+		want       string
+		wantErr    bool
+	}{
+		{name: "direct", remoteAddr: "10.1.2.3:4567", want: "10.1.2.3"},
+		{name: "header not configured", remoteAddr: "10.0.0.1:4567", forwarded: "10.9.9.9", want: "10.0.0.1"},
+		{name: "spoofed by untrusted caller", header: "X-Forwarded-For", remoteAddr: "10.1.2.3:4567", forwarded: "10.9.9.9", want: "10.1.2.3"},
+		{name: "trusted proxy", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:4567", forwarded: "10.9.9.9", want: "10.9.9.9"},
+		{name: "spoofed entries before the proxy's", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:4567", forwarded: "10.6.6.6, 10.7.7.7,10.9.9.9", want: "10.9.9.9"},
+		{name: "trusted proxy without header", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:4567", want: "10.0.0.1"},
+		{name: "invalid header", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:4567", forwarded: "10.9.9.9, pod", wantErr: true},
+		{name: "header with port", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:4567", forwarded: "10.9.9.9:80", wantErr: true},
+		{name: "custom header", header: "X-Real-IP", remoteAddr: "10.0.0.1:4567", forwarded: "10.9.9.9", want: "10.9.9.9"},
+		{name: "ipv6 direct", remoteAddr: "[2001:db8::1]:4567", want: "2001:db8::1"},
+		{name: "ipv6 trusted proxy", header: "X-Forwarded-For", remoteAddr: "[fd00::1]:4567", forwarded: "2001:DB8:0:0::2", want: "2001:db8::2"},
+		{name: "ipv6 untrusted caller", header: "X-Forwarded-For", remoteAddr: "[fd00:0:0:1::1]:4567", forwarded: "2001:db8::2", want: "fd00:0:0:1::1"},
+		{name: "ipv4 mapped ipv6", header: "X-Forwarded-For", remoteAddr: "[::ffff:10.0.0.1]:4567", forwarded: "10.9.9.9", want: "10.9.9.9"},
+		{name: "missing port", remoteAddr: "10.1.2.3", wantErr: true},
+		{name: "ipv6 missing port", remoteAddr: "2001:db8::1", wantErr: true},
+		{name: "missing port behind proxy", header: "X-Forwarded-For", remoteAddr: "10.0.0.1", forwarded: "10.9.9.9", wantErr: true},
+	}
+	for _, tt := range tests {
+		forwardedHeader = tt.header
+		trustedProxies = nil
+		if tt.header != "" {
+			trustedProxies = proxies
+		}
+		r := httptest.NewRequest("POST", "/token", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+			r.Header.Set("X-Real-IP", tt.forwarded)
+		}
+
+		got, err := requestSourceIP(r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: requestSourceIP() = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: requestSourceIP() returned error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: requestSourceIP() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSameIP(t *testing.T) {
+	tests := []struct {
+		sourceIP string
+		podIP    string
+		want     bool
+	}{
+		{"10.1.2.3", "10.1.2.3", true},
+		{"10.1.2.3", "10.1.2.4", false},
+		{"::ffff:10.1.2.3", "10.1.2.3", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8:0:0:0:0:0:1", "2001:db8::1", true},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"2001:db8::2", "2001:db8::1", false},
+		{"fd00:0:0:1::1", "fd00:0:0:1:0:0:0:1", true},
+		{"pod", "pod", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := sameIP(tt.sourceIP, tt.podIP); got != tt.want {
+			t.Errorf("sameIP(%q, %q) = %v, want %v", tt.sourceIP, tt.podIP, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// ownerCacheTTL is how long the owner of a ReplicaSet or Job is
+	// remembered. Owners are set when the object is created and rarely
+	// change, so a stale entry at worst names the previous owner.
+	ownerCacheTTL = 10 * time.Minute
+
+	// ownerCacheSize bounds the number of remembered owners.
+	ownerCacheSize = 4096
+)
+
+// owners caches the workload owner of ReplicaSets and Jobs by UID, so pods
+// of the same workload requesting tokens together resolve it once.
+var owners = &ownerCache{entries: make(map[string]ownerEntry)}
+
+type ownerCache struct {
+	sync.Mutex
+	entries map[string]ownerEntry
+}
+
+type ownerEntry struct {
+	kind    string
+	name    string
+	expires time.Time
+}
+
+func (c *ownerCache) get(uid string, now time.Time) (string, string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[uid]
+	if !ok || now.After(e.expires) {
+		return "", "", false
+	}
+	return e.kind, e.name, true
+}
+
+func (c *ownerCache) put(uid, kind, name string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= ownerCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= ownerCacheSize {
+			return
+		}
+	}
+	c.entries[uid] = ownerEntry{kind: kind, name: name, expires: now.Add(ownerCacheTTL)}
+}
+
+// tokenMetadata returns the metadata attached to a token issued to the pod,
+// so Vault audit logs and token lookups can be traced back to the workload.
+func tokenMetadata(pod *Pod) map[string]string {
+	metadata := map[string]string{
+		"host_ip":              pod.Status.HostIP,
+		"namespace":            pod.Metadata.Namespace,
+		"pod_ip":               pod.Status.PodIP,
+		"pod_name":             pod.Metadata.Name,
+		"pod_uid":              pod.Metadata.Uid,
+		"service_account_name": pod.Spec.ServiceAccountName,
+		"node_name":            pod.Spec.NodeName,
+	}
+	if kind, name := workloadOwner(pod); kind != "" {
+		metadata["owner_kind"] = kind
+		metadata["owner_name"] = name
+	}
+	if controllerConfig.TokenMetadata.ClusterName != "" {
+		metadata["cluster_name"] = controllerConfig.TokenMetadata.ClusterName
+	}
+	for _, label := range controllerConfig.TokenMetadata.Labels {
+		if value, ok := pod.Metadata.Labels[label]; ok {
+			metadata["label_"+label] = value
+		}
+	}
+	return metadata
+}
+
+// workloadOwner returns the kind and name of the workload that manages the
+// pod. Pods created by a ReplicaSet or Job are attributed to the Deployment
+// or CronJob that owns it, when there is one. If that lookup fails the
+// ReplicaSet or Job itself is returned. Successful lookups are cached.
+func workloadOwner(pod *Pod) (string, string) {
+	ref := controllerRef(pod.Metadata.OwnerReferences)
+	if ref == nil {
+		return "", ""
+	}
+
+	var path string
+	switch ref.Kind {
+	case "ReplicaSet":
+		path = fmt.Sprintf("/apis/apps/v1/namespaces/%s/replicasets/%s", url.PathEscape(pod.Metadata.Namespace), url.PathEscape(ref.Name))
+	case "Job":
+		path = fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", url.PathEscape(pod.Metadata.Namespace), url.PathEscape(ref.Name))
+	default:
+		return ref.Kind, ref.Name
+	}
+
+	now := time.Now()
+	if kind, name, ok := owners.get(ref.Uid, now); ok {
+		return kind, name
+	}
+	refs, err := kubeClient.getOwnerReferences(path)
+	if err != nil {
+		log.Printf("error resolving owner of %s %s: %v", ref.Kind, podKey(pod.Metadata.Namespace, ref.Name), err)
+		return ref.Kind, ref.Name
+	}
+	kind, name := ref.Kind, ref.Name
+	if owner := controllerRef(refs); owner != nil {
+		kind, name = owner.Kind, owner.Name
+	}
+	if ref.Uid != "" {
+		owners.put(ref.Uid, kind, name, now)
+	}
+	return kind, name
+}
+
+// controllerRef returns the owner reference of the managing controller.
+func controllerRef(refs []OwnerReference) *OwnerReference {
+	for i := range refs {
+		if refs[i].Controller != nil && *refs[i].Controller {
+			return &refs[i]
+		}
+	}
+	return nil
+}
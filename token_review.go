@@ -0,0 +1,141 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// defaultTokenAudience is the audience of the projected service account
+	// token vault-init sends. A dedicated audience keeps tokens meant for
+	// the API server, or for anything else, from being replayed here, and
+	// tokens sent here from being replayed elsewhere.
+	defaultTokenAudience = "vault-controller"
+
+	serviceAccountPrefix = "system:serviceaccount:"
+	podNameExtraKey      = "authentication.kubernetes.io/pod-name"
+	podUIDExtraKey       = "authentication.kubernetes.io/pod-uid"
+)
+
+// identity is the authenticated service account behind a token request.
+// The TokenReview status is kept so later checks can make policy decisions
+// based on the groups and extra fields reported by the API server.
+type identity struct {
+	Username       string
+	Namespace      string
+	ServiceAccount string
+	PodName        string
+	PodUID         string
+	Review         TokenReviewStatus
+}
+
+// authenticateRequest validates the bearer token sent with the request using
+// the Kubernetes TokenReview API. The returned status code is meant to be
+// returned to the caller when err is not nil.
+func authenticateRequest(r *http.Request) (*identity, int, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, 401, errors.New("missing service account bearer token")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == "" {
+		return nil, 401, errors.New("missing service account bearer token")
+	}
+
+	status, err := reviewToken(token)
+	if err != nil {
+		return nil, 500, err
+	}
+	if !status.Authenticated {
+		reason := status.Error
+		if reason == "" {
+			reason = "token not authenticated"
+		}
+		return nil, 401, fmt.Errorf("service account token rejected: %s", reason)
+	}
+	// An authenticator that ignores the requested audiences would accept
+	// tokens meant for the API server, so the audiences are checked here.
+	if !sharesAudience(status.Audiences, tokenAudiences) {
+		return nil, 401, fmt.Errorf("service account token rejected: not issued for audience %s", strings.Join(tokenAudiences, ","))
+	}
+
+	username := status.User.Username
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return nil, 403, fmt.Errorf("%s is not a service account", username)
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if len(parts) != 2 {
+		return nil, 403, fmt.Errorf("malformed service account username %s", username)
+	}
+
+	id := &identity{
+		Username:       username,
+		Namespace:      parts[0],
+		ServiceAccount: parts[1],
+		Review:         *status,
+	}
+	if v := status.User.Extra[podNameExtraKey]; len(v) > 0 {
+		id.PodName = v[0]
+	}
+	if v := status.User.Extra[podUIDExtraKey]; len(v) > 0 {
+		id.PodUID = v[0]
+	}
+	return id, 200, nil
+}
+
+// verifyPod ensures the authenticated service account token was issued to
+// the given pod.
+func (id *identity) verifyPod(pod *Pod) error {
+	if id.Namespace != pod.Metadata.Namespace || id.ServiceAccount != pod.Spec.ServiceAccountName {
+		return fmt.Errorf("service account %s does not match pod service account %s", id.Username, pod.Spec.ServiceAccountName)
+	}
+	if id.PodUID == "" {
+		return errors.New("service account token is not bound to a pod")
+	}
+	if id.PodUID != pod.Metadata.Uid {
+		return fmt.Errorf("service account token is bound to pod uid %s, not %s", id.PodUID, pod.Metadata.Uid)
+	}
+	return nil
+}
+
+// sharesAudience reports whether the audiences a token was validated for
+// include one of the wanted audiences.
+func sharesAudience(audiences, wanted []string) bool {
+	for _, a := range audiences {
+		for _, w := range wanted {
+			if a == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reviewToken(token string) (*TokenReviewStatus, error) {
+	tr := TokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec: TokenReviewSpec{
+			Token:     token,
+			Audiences: tokenAudiences,
+		},
+	}
+	result, err := kubeClient.createTokenReview(&tr)
+	if err != nil {
+		return nil, fmt.Errorf("error during token review: %s", err)
+	}
+	return &result.Status, nil
+}
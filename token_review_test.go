@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// fakeKubernetes points kubeClient at a test server serving handler and
+// returns a function restoring the previous client.
+func fakeKubernetes(handler http.Handler) (*httptest.Server, func()) {
+	server := httptest.NewServer(handler)
+	previous := kubeClient
+	kubeClient = &kubernetesClient{host: server.URL, client: server.Client(), streamClient: server.Client()}
+	return server, func() {
+		kubeClient = previous
+		server.Close()
+	}
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	defer func(audiences []string) { tokenAudiences = audiences }(tokenAudiences)
+	tokenAudiences = []string{"vault-controller"}
+
+	authenticated := TokenReviewStatus{
+		Authenticated: true,
+		User: UserInfo{
+			Username: "system:serviceaccount:default:web",
+			Extra: map[string][]string{
+				podNameExtraKey: {"web-1"},
+				podUIDExtraKey:  {"1234"},
+			},
+		},
+		Audiences: []string{"vault-controller"},
+	}
+	other := authenticated
+	other.Audiences = []string{"https://kubernetes.default.svc"}
+	none := authenticated
+	none.Audiences = nil
+	user := authenticated
+	user.User.Username = "jane"
+	rejected := TokenReviewStatus{Error: "token expired"}
+
+	tests := []struct {
+		name     string
+		header   string
+		status   TokenReviewStatus
+		wantCode int
+	}{
+		{name: "authenticated", header: "Bearer token", status: authenticated, wantCode: 200},
+		{name: "no token", wantCode: 401},
+		{name: "empty token", header: "Bearer  ", wantCode: 401},
+		{name: "not authenticated", header: "Bearer token", status: rejected, wantCode: 401},
+		{name: "other audience", header: "Bearer token", status: other, wantCode: 401},
+		{name: "no audiences", header: "Bearer token", status: none, wantCode: 401},
+		{name: "not a service account", header: "Bearer token", status: user, wantCode: 403},
+	}
+	for _, tt := range tests {
+		var review TokenReview
+		_, done := fakeKubernetes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				t.Errorf("%s: error decoding token review: %v", tt.name, err)
+			}
+			review.Status = tt.status
+			json.NewEncoder(w).Encode(&review)
+		}))
+
+		r := httptest.NewRequest("GET", "/token", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		id, code, err := authenticateRequest(r)
+		done()
+		if code != tt.wantCode {
+			t.Errorf("%s: authenticateRequest() code = %d (%v), want %d", tt.name, code, err, tt.wantCode)
+			continue
+		}
+		if tt.wantCode != 200 {
+			if err == nil {
+				t.Errorf("%s: authenticateRequest() returned no error", tt.name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(review.Spec.Audiences, tokenAudiences) {
+			t.Errorf("%s: token review audiences = %v, want %v", tt.name, review.Spec.Audiences, tokenAudiences)
+		}
+		want := identity{
+			Username:       "system:serviceaccount:default:web",
+			Namespace:      "default",
+			ServiceAccount: "web",
+			PodName:        "web-1",
+			PodUID:         "1234",
+			Review:         tt.status,
+		}
+		if !reflect.DeepEqual(*id, want) {
+			t.Errorf("%s: authenticateRequest() = %+v, want %+v", tt.name, *id, want)
+		}
+	}
+}
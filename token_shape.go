@@ -0,0 +1,185 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTokenTTL = 72 * time.Hour
+
+// tokenShape holds the validated lifetime and usage settings of a token.
+type tokenShape struct {
+	TTL            time.Duration
+	Period         time.Duration
+	ExplicitMaxTTL time.Duration
+	NumUses        int
+	Renewable      *bool
+	EntityAlias    string
+	WrapTTL        time.Duration
+}
+
+// tokenShape validates the settings requested by the grant, fills in the
+// configured defaults and clamps the result to the configured maximums.
+func (c *Config) tokenShape(g *tokenGrant) (*tokenShape, error) {
+	s := &tokenShape{
+		NumUses:     c.TokenDefaults.NumUses,
+		Renewable:   c.TokenDefaults.Renewable,
+		EntityAlias: g.EntityAlias,
+	}
+
+	var err error
+	if s.TTL, err = durationSetting("ttl", g.TTL, c.TokenDefaults.TTL); err != nil {
+		return nil, err
+	}
+	if s.TTL == 0 {
+		s.TTL = defaultTokenTTL
+	}
+	if s.Period, err = durationSetting("period", g.Period, c.TokenDefaults.Period); err != nil {
+		return nil, err
+	}
+	if s.ExplicitMaxTTL, err = durationSetting("explicit-max-ttl", g.ExplicitMaxTTL, c.TokenDefaults.ExplicitMaxTTL); err != nil {
+		return nil, err
+	}
+	if s.WrapTTL, err = durationSetting("wrap-ttl", g.WrapTTL, os.Getenv("VAULT_WRAP_TTL")); err != nil {
+		return nil, err
+	}
+	if g.WrapTTL != "" && s.WrapTTL == 0 {
+		return nil, fmt.Errorf("invalid wrap-ttl %q: must be greater than zero", g.WrapTTL)
+	}
+
+	if g.NumUses != "" {
+		n, err := strconv.Atoi(g.NumUses)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid num-uses %q: must be a non-negative integer", g.NumUses)
+		}
+		s.NumUses = n
+	}
+	if g.Renewable != "" {
+		b, err := strconv.ParseBool(g.Renewable)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renewable %q: must be true or false", g.Renewable)
+		}
+		s.Renewable = &b
+	}
+	if s.EntityAlias != "" && g.Role == "" {
+		return nil, fmt.Errorf("entity-alias %q requires a token role", s.EntityAlias)
+	}
+
+	maxTTL, _ := parseDuration(c.TokenLimits.MaxTTL)
+	maxPeriod, _ := parseDuration(c.TokenLimits.MaxPeriod)
+	maxExplicitMaxTTL, _ := parseDuration(c.TokenLimits.MaxExplicitMaxTTL)
+	minWrapTTL, _ := parseDuration(c.TokenLimits.MinWrapTTL)
+	maxWrapTTL, _ := parseDuration(c.TokenLimits.MaxWrapTTL)
+	if maxTTL > 0 && s.TTL > maxTTL {
+		s.TTL = maxTTL
+	}
+	if maxPeriod > 0 && s.Period > maxPeriod {
+		s.Period = maxPeriod
+	}
+	if maxExplicitMaxTTL > 0 && (s.ExplicitMaxTTL == 0 || s.ExplicitMaxTTL > maxExplicitMaxTTL) {
+		s.ExplicitMaxTTL = maxExplicitMaxTTL
+	}
+	if minWrapTTL > 0 && s.WrapTTL < minWrapTTL {
+		s.WrapTTL = minWrapTTL
+	}
+	if maxWrapTTL > 0 && s.WrapTTL > maxWrapTTL {
+		s.WrapTTL = maxWrapTTL
+	}
+	// An unwrapped token could not be pushed safely.
+	if s.WrapTTL == 0 {
+		return nil, fmt.Errorf("no wrap-ttl requested and none configured")
+	}
+	if s.ExplicitMaxTTL > 0 && s.TTL > s.ExplicitMaxTTL {
+		s.TTL = s.ExplicitMaxTTL
+	}
+	// Zero uses means unlimited, so it is clamped like any other value.
+	if maxNumUses := c.TokenLimits.MaxNumUses; maxNumUses > 0 && (s.NumUses == 0 || s.NumUses > maxNumUses) {
+		s.NumUses = maxNumUses
+	}
+	if c.TokenLimits.ForceNonRenewable {
+		renewable := false
+		s.Renewable = &renewable
+	}
+	return s, nil
+}
+
+// durationSetting parses the requested value of a duration setting, or the
+// configured default when nothing was requested.
+func durationSetting(name, requested, fallback string) (time.Duration, error) {
+	if requested == "" {
+		requested = fallback
+	}
+	d, err := parseDuration(requested)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, requested, err)
+	}
+	return d, nil
+}
+
+// parseDuration accepts the duration formats Vault accepts: a number of
+// seconds, a Go duration such as "1h30m", or a number of days such as
+// "7d". An empty string is zero. Vault counts in whole seconds, so
+// fractions of a second are rejected rather than rounded.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return scaleDuration(n, time.Second)
+	}
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("must be a number of seconds or a duration such as 72h")
+		}
+		return scaleDuration(n, 24*time.Hour)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("must be a number of seconds or a duration such as 72h")
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	if d%time.Second != 0 {
+		return 0, fmt.Errorf("must be a whole number of seconds")
+	}
+	return d, nil
+}
+
+// scaleDuration returns n units, rejecting values that do not fit in a
+// time.Duration rather than letting them wrap around.
+func scaleDuration(n int64, unit time.Duration) (time.Duration, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return 0, fmt.Errorf("must not be longer than %v", time.Duration(math.MaxInt64).Truncate(unit))
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// vaultDuration formats d as a number of seconds for the Vault API. Zero
+// is sent as an empty string so Vault applies its own default.
+func vaultDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
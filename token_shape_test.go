@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: " ", want: 0},
+		{in: "0", want: 0},
+		{in: "3600", want: time.Hour},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "9223372036", want: 9223372036 * time.Second},
+		{in: "106751d", want: 106751 * 24 * time.Hour},
+
+		// Values that would overflow a time.Duration.
+		{in: "9223372037", wantErr: true},
+		{in: "9223372036854775807", wantErr: true},
+		{in: "106752d", wantErr: true},
+		{in: "9223372036854775807d", wantErr: true},
+		{in: "2562048h", wantErr: true},
+
+		{in: "-1", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "72", want: 72 * time.Second},
+		{in: "72x", wantErr: true},
+		{in: "90s", want: 90 * time.Second},
+		{in: "500ms", wantErr: true},
+		{in: "1.5s", wantErr: true},
+		{in: "1.5m", want: 90 * time.Second},
+		{in: "forever", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDuration(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDuration(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTokenShapeLimits(t *testing.T) {
+	renewable := true
+	config := &Config{
+		TokenDefaults: TokenDefaults{TTL: "24h", Renewable: &renewable},
+		TokenLimits: TokenLimits{
+			MaxTTL:            "48h",
+			MaxPeriod:         "12h",
+			MaxExplicitMaxTTL: "7d",
+			MinWrapTTL:        "30s",
+			MaxWrapTTL:        "5m",
+			MaxNumUses:        10,
+			ForceNonRenewable: true,
+		},
+	}
+	tests := []struct {
+		name  string
+		grant tokenGrant
+		want  tokenShape
+	}{
+		{
+			name:  "defaults",
+			grant: tokenGrant{},
+			want:  tokenShape{TTL: 24 * time.Hour, ExplicitMaxTTL: 7 * 24 * time.Hour, WrapTTL: 30 * time.Second, NumUses: 10},
+		},
+		{
+			name:  "within limits",
+			grant: tokenGrant{TTL: "1h", Period: "1h", ExplicitMaxTTL: "2d", WrapTTL: "2m", NumUses: "3"},
+			want:  tokenShape{TTL: time.Hour, Period: time.Hour, ExplicitMaxTTL: 48 * time.Hour, WrapTTL: 2 * time.Minute, NumUses: 3},
+		},
+		{
+			name:  "clamped",
+			grant: tokenGrant{TTL: "30d", Period: "1d", ExplicitMaxTTL: "365d", WrapTTL: "1h", NumUses: "100", Renewable: "true"},
+			want:  tokenShape{TTL: 48 * time.Hour, Period: 12 * time.Hour, ExplicitMaxTTL: 7 * 24 * time.Hour, WrapTTL: 5 * time.Minute, NumUses: 10},
+		},
+		{
+			name:  "unlimited uses",
+			grant: tokenGrant{NumUses: "0"},
+			want:  tokenShape{TTL: 24 * time.Hour, ExplicitMaxTTL: 7 * 24 * time.Hour, WrapTTL: 30 * time.Second, NumUses: 10},
+		},
+		{
+			name:  "ttl capped by explicit max ttl",
+			grant: tokenGrant{TTL: "40h", ExplicitMaxTTL: "1d"},
+			want:  tokenShape{TTL: 24 * time.Hour, ExplicitMaxTTL: 24 * time.Hour, WrapTTL: 30 * time.Second, NumUses: 10},
+		},
+	}
+	for _, tt := range tests {
+		got, err := config.tokenShape(&tt.grant)
+		if err != nil {
+			t.Errorf("%s: tokenShape() returned error: %v", tt.name, err)
+			continue
+		}
+		if got.Renewable == nil || *got.Renewable {
+			t.Errorf("%s: tokenShape() renewable = %v, want false", tt.name, got.Renewable)
+		}
+		got.Renewable = nil
+		if *got != tt.want {
+			t.Errorf("%s: tokenShape() = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestTokenShapeInvalid(t *testing.T) {
+	defer os.Setenv("VAULT_WRAP_TTL", os.Getenv("VAULT_WRAP_TTL"))
+	os.Unsetenv("VAULT_WRAP_TTL")
+
+	config := &Config{}
+	tests := []struct {
+		name  string
+		grant tokenGrant
+	}{
+		{name: "fractional ttl", grant: tokenGrant{TTL: "1.5s", WrapTTL: "30s"}},
+		{name: "sub-second wrap ttl", grant: tokenGrant{WrapTTL: "500ms"}},
+		{name: "zero wrap ttl", grant: tokenGrant{WrapTTL: "0"}},
+		{name: "zero days wrap ttl", grant: tokenGrant{WrapTTL: "0d"}},
+		{name: "no wrap ttl", grant: tokenGrant{}},
+	}
+	for _, tt := range tests {
+		if got, err := config.tokenShape(&tt.grant); err == nil {
+			t.Errorf("%s: tokenShape() = %+v, want an error", tt.name, *got)
+		}
+	}
+}
@@ -19,13 +19,18 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-const tokenFile = "/var/run/secrets/vaultproject.io/secret.json"
+const (
+	tokenFile                 = "/var/run/secrets/vaultproject.io/secret.json"
+	defaultServiceAccountFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
 
 func main() {
 	log.Println("Starting vault-init...")
@@ -50,15 +55,22 @@ func main() {
 		vaultControllerAddr = "http://vault-controller"
 	}
 
-	http.Handle("/", tokenHandler{vaultAddr})
-	go func() {
-		log.Fatal(http.ListenAndServe(":80", nil))
-	}()
+	serviceAccountTokenFile := os.Getenv("SERVICE_ACCOUNT_TOKEN_FILE")
+	if serviceAccountTokenFile == "" {
+		serviceAccountTokenFile = defaultServiceAccountFile
+	}
 
-	// Ensure the token handler is ready.
-	time.Sleep(time.Millisecond * 300)
+	// "vault-init revoke" revokes the pod's tokens from a preStop hook.
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		if err := revoke(vaultControllerAddr, vaultAddr, name, namespace, serviceAccountTokenFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Remove exiting token files before requesting a new one.
+	// Remove exiting token files before requesting a new one. This and the
+	// file watch must be in place before the token handler starts since the
+	// controller may push a token as soon as the pod has an IP.
 	if err := os.Remove(tokenFile); err != nil {
 		log.Printf("could not remove token file at %s: %s", tokenFile, err)
 	}
@@ -73,27 +85,40 @@ func main() {
 		log.Fatalf("could not add watcher: %v", err)
 	}
 
+	// Only Vault addresses we were configured with are trusted; the pushed
+	// payload is not authenticated.
+	allowedVaultAddrs := []string{vaultAddr}
+	if addrs := os.Getenv("VAULT_ALLOWED_ADDRS"); addrs != "" {
+		allowedVaultAddrs = strings.Split(addrs, ",")
+	}
+
+	http.Handle("/", tokenHandler{vaultAddr, allowedVaultAddrs})
+	go func() {
+		log.Fatal(http.ListenAndServe(":80", nil))
+	}()
+
+	// Ensure the token handler is ready.
+	time.Sleep(time.Millisecond * 300)
+
 	done := make(chan bool)
 	retryDelay := 5 * time.Second
 	go func() {
 		for {
-			err := requestToken(vaultControllerAddr, name, namespace)
+			err := requestToken(vaultControllerAddr, name, namespace, serviceAccountTokenFile)
 			if err != nil {
-				log.Printf("token request: Request error %v; retrying in %v", err, retryDelay)
-				time.Sleep(retryDelay)
+				delay := retryDelay
+				if e, ok := err.(*retryAfterError); ok && e.after > delay {
+					delay = e.after
+				}
+				log.Printf("token request: Request error %v; retrying in %v", err, delay)
+				time.Sleep(delay)
 				continue
 			}
 			log.Println("Token request complete; waiting for callback...")
-			select {
-			case <-time.After(time.Second * 30):
-				log.Println("token request: Timeout waiting for callback")
-				break
-			case <-tokenWatcher.Events:
+			if waitForTokenFile(tokenWatcher) {
 				tokenWatcher.Close()
 				close(done)
 				return
-			case err := <-tokenWatcher.Errors:
-				log.Println("token request: error watching the token file", err)
 			}
 		}
 	}()
@@ -108,10 +133,32 @@ func main() {
 	}
 }
 
-func requestToken(vaultControllerAddr, name, namespace string) error {
+// readServiceAccountToken reads the service account token sent to the
+// controller. Projected service account tokens are rotated by the kubelet,
+// so the file is read for every request rather than kept.
+func readServiceAccountToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read service account token: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func requestToken(vaultControllerAddr, name, namespace, serviceAccountTokenFile string) error {
+	serviceAccountToken, err := readServiceAccountToken(serviceAccountTokenFile)
+	if err != nil {
+		return err
+	}
+
 	u := fmt.Sprintf("%s/token?name=%s&namespace=%s", vaultControllerAddr, name, namespace)
 	log.Printf("Requesting a new wrapped token from %s", vaultControllerAddr)
-	resp, err := http.Post(u, "", nil)
+	request, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Authorization", "Bearer "+serviceAccountToken)
+
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return err
 	}
@@ -125,5 +172,39 @@ func requestToken(vaultControllerAddr, name, namespace string) error {
 	if err != nil {
 		return err
 	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return &retryAfterError{fmt.Errorf("%s", data), time.Duration(seconds) * time.Second}
+	}
 	return fmt.Errorf("%s", data)
 }
+
+// retryAfterError is returned when the controller asks to be called again
+// no sooner than after.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// waitForTokenFile waits for the token handler to write the token file.
+// Secret files written to the same directory before it are ignored.
+func waitForTokenFile(watcher *fsnotify.Watcher) bool {
+	timeout := time.After(time.Second * 30)
+	for {
+		select {
+		case <-timeout:
+			log.Println("token request: Timeout waiting for callback")
+			return false
+		case event := <-watcher.Events:
+			if event.Name == tokenFile {
+				return true
+			}
+		case err := <-watcher.Errors:
+			log.Println("token request: error watching the token file", err)
+			return false
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// revoke revokes the pod's tokens, for use in a preStop hook. The
+// controller is asked first since it also revokes the tokens holding the
+// leases of delivered secrets. If it cannot be reached, or the container has
+// no service account token it accepts, the token in the token file revokes
+// itself and the secrets token is left to the controller. Running revoke
+// more than once is safe.
+func revoke(vaultControllerAddr, vaultAddr, name, namespace, serviceAccountTokenFile string) error {
+	err := requestRevoke(vaultControllerAddr, name, namespace, serviceAccountTokenFile)
+	if err == nil {
+		return nil
+	}
+	log.Printf("revoke: controller revocation failed: %v; revoking the token directly", err)
+
+	return revokeSelf(vaultAddr)
+}
+
+func requestRevoke(vaultControllerAddr, name, namespace, serviceAccountTokenFile string) error {
+	serviceAccountToken, err := readServiceAccountToken(serviceAccountTokenFile)
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/revoke?name=%s&namespace=%s", vaultControllerAddr, url.QueryEscape(name), url.QueryEscape(namespace))
+	log.Printf("Requesting token revocation from %s", vaultControllerAddr)
+	request, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Authorization", "Bearer "+serviceAccountToken)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	log.Println("revoke: tokens revoked by the controller")
+	return nil
+}
+
+// revokeSelf revokes the token in the token file with auth/token/revoke-self
+// against the Vault it was unwrapped from. vaultAddr is only used for token
+// files written before the address was recorded. The token holding the
+// leases of delivered secrets is never handed to the pod, so it stays valid
+// until the controller revokes it once the pod is gone.
+func revokeSelf(vaultAddr string) error {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read token file: %v", err)
+	}
+	var secret tokenSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return err
+	}
+	if secret.Secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return fmt.Errorf("no token in %s", tokenFile)
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	if secret.VaultAddr != "" {
+		vaultAddr = secret.VaultAddr
+	}
+	client.SetAddress(vaultAddr)
+	client.SetNamespace(secret.VaultNamespace)
+	client.SetToken(secret.Auth.ClientToken)
+
+	err = client.Auth().Token().RevokeSelf("")
+	if e, ok := err.(*api.ResponseError); ok && e.StatusCode == 403 {
+		// The token is already gone.
+		log.Println("revoke: token was already revoked or has expired")
+	} else if err != nil {
+		return err
+	} else {
+		log.Println("revoke: token revoked")
+	}
+	log.Println("revoke: the token holding the leases of delivered secrets was not revoked; the controller revokes it once the pod is deleted")
+	return nil
+}
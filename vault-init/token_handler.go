@@ -13,16 +13,46 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/hashicorp/vault/api"
 )
 
 type tokenHandler struct {
 	vaultAddr string
+
+	// allowedVaultAddrs limits the addresses the controller may ask us to
+	// unwrap against. No address is accepted when empty.
+	allowedVaultAddrs []string
+}
+
+// wrappedToken is the payload pushed by the vault-controller.
+type wrappedToken struct {
+	api.SecretWrapInfo
+	VaultAddr      string          `json:"vault_addr"`
+	VaultNamespace string          `json:"vault_namespace"`
+	Secrets        []wrappedSecret `json:"secrets"`
+}
+
+// wrappedSecret is a secret the vault-controller read for the pod.
+type wrappedSecret struct {
+	Path string `json:"path"`
+	api.SecretWrapInfo
+}
+
+// tokenSecret is written to the token file. It records the Vault and the
+// Vault namespace the token was created in so clients can send their
+// requests there.
+type tokenSecret struct {
+	*api.Secret
+	VaultAddr      string `json:"vault_addr,omitempty"`
+	VaultNamespace string `json:"vault_namespace,omitempty"`
 }
 
 func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -33,7 +63,7 @@ func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var swi api.SecretWrapInfo
+	var swi wrappedToken
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
@@ -49,6 +79,17 @@ func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secretFiles := make([]string, len(swi.Secrets))
+	for i, s := range swi.Secrets {
+		name, err := secretFileName(s.Path)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(400)
+			return
+		}
+		secretFiles[i] = filepath.Join(filepath.Dir(tokenFile), name)
+	}
+
 	config := api.DefaultConfig()
 	client, err := api.NewClient(config)
 	if err != nil {
@@ -57,26 +98,71 @@ func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client.SetToken(swi.Token)
-	client.SetAddress(h.vaultAddr)
+	vaultAddr := h.vaultAddr
+	if swi.VaultAddr != "" {
+		vaultAddr = swi.VaultAddr
+	}
+	// Anyone who can reach the pod can push a payload, and a Vault they
+	// control would pass the wrapping token checks below.
+	if !h.vaultAddrAllowed(vaultAddr) {
+		log.Printf("Vault address %s is not allowed", vaultAddr)
+		w.WriteHeader(403)
+		return
+	}
 
-	// Vault knows to unwrap the client token if the token to unwrap is empty.
-	secret, err := client.Logical().Unwrap("")
+	client.SetAddress(vaultAddr)
+	client.SetNamespace(swi.VaultNamespace)
+
+	// Make sure every wrapping token is still unused and holds what it
+	// claims to before unwrapping any of them. A wrapping token that is gone
+	// before it expired was unwrapped by someone else, which the controller
+	// must hear about.
+	code, err := lookupWrappingToken(client, swi.Token, func(creationPath string) bool {
+		return strings.HasPrefix(creationPath, "auth/token/create")
+	})
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		w.WriteHeader(code)
 		return
 	}
+	for _, s := range swi.Secrets {
+		path := s.Path
+		code, err := lookupWrappingToken(client, s.Token, func(creationPath string) bool {
+			return creationPath == path
+		})
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(code)
+			return
+		}
+	}
 
-	f, err := os.Create(tokenFile)
+	secret, code, err := unwrap(client, swi.Token)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		w.WriteHeader(code)
 		return
 	}
-	defer f.Close()
+	secrets := make([]*api.Secret, len(swi.Secrets))
+	for i, s := range swi.Secrets {
+		secrets[i], code, err = unwrap(client, s.Token)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(code)
+			return
+		}
+	}
 
-	err = json.NewEncoder(f).Encode(&secret)
+	// The token file is written last; vault-init is done once it exists.
+	for i, f := range secretFiles {
+		if err := writeJSON(f, secrets[i]); err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		log.Printf("wrote %s", f)
+	}
+	err = writeJSON(tokenFile, &tokenSecret{Secret: secret, VaultAddr: vaultAddr, VaultNamespace: swi.VaultNamespace})
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(500)
@@ -85,3 +171,107 @@ func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("wrote %s", tokenFile)
 	w.WriteHeader(200)
 }
+
+// lookupWrappingToken checks that the wrapping token exists and was created
+// by a request at a path accepted by validPath. The returned status code is
+// meant for the controller when err is not nil.
+func lookupWrappingToken(client *api.Client, token string, validPath func(string) bool) (int, error) {
+	client.SetToken(token)
+	lookup, err := client.Logical().Write("sys/wrapping/lookup", map[string]interface{}{
+		"token": token,
+	})
+	if err != nil {
+		if isInvalidWrappingToken(err) {
+			return 410, fmt.Errorf("wrapping token was already unwrapped or has expired: %v", err)
+		}
+		return 500, err
+	}
+	if lookup == nil {
+		return 500, fmt.Errorf("empty wrapping token lookup response")
+	}
+	if creationPath, _ := lookup.Data["creation_path"].(string); !validPath(creationPath) {
+		return 400, fmt.Errorf("unexpected wrapping token creation path %q", creationPath)
+	}
+	return 200, nil
+}
+
+// unwrap unwraps the wrapping token. The returned status code is meant for
+// the controller when err is not nil.
+func unwrap(client *api.Client, token string) (*api.Secret, int, error) {
+	// Vault knows to unwrap the client token if the token to unwrap is empty.
+	client.SetToken(token)
+	secret, err := client.Logical().Unwrap("")
+	if err != nil {
+		if isInvalidWrappingToken(err) {
+			return nil, 410, err
+		}
+		return nil, 500, err
+	}
+	if secret == nil {
+		return nil, 500, fmt.Errorf("empty unwrap response")
+	}
+	return secret, 200, nil
+}
+
+// secretFileName returns the name of the file the secret at path is
+// written to, such as database_creds_app.json for database/creds/app.
+func secretFileName(path string) (string, error) {
+	path = strings.Trim(path, "/")
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid secret path %q", path)
+		}
+	}
+	name := strings.Replace(path, "/", "_", -1) + ".json"
+	if name == filepath.Base(tokenFile) {
+		return "", fmt.Errorf("secret path %q conflicts with the token file", path)
+	}
+	return name, nil
+}
+
+// writeJSON writes v to a temporary file and renames it into place, so the
+// file is never seen half written.
+func writeJSON(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// isInvalidWrappingToken reports whether Vault rejected the wrapping token
+// because it has already been unwrapped or has expired.
+func isInvalidWrappingToken(err error) bool {
+	e, ok := err.(*api.ResponseError)
+	if !ok || e.StatusCode != 400 {
+		return false
+	}
+	for _, msg := range e.Errors {
+		if strings.Contains(msg, "wrapping token is not valid or does not exist") {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultAddrAllowed reports whether addr is one of the allowed Vault
+// addresses. Trailing slashes are ignored.
+func (h tokenHandler) vaultAddrAllowed(addr string) bool {
+	addr = strings.TrimSuffix(addr, "/")
+	for _, a := range h.allowedVaultAddrs {
+		if strings.TrimSuffix(strings.TrimSpace(a), "/") == addr {
+			return true
+		}
+	}
+	return false
+}
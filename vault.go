@@ -0,0 +1,305 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// defaultVaultName names the backend configured from the environment.
+const defaultVaultName = "default"
+
+// orphanRoleCacheTTL is how long a token role is trusted to create orphan
+// tokens before it is read again.
+const orphanRoleCacheTTL = 5 * time.Minute
+
+// vaultBackend is a Vault cluster the controller issues tokens from.
+type vaultBackend struct {
+	name    string
+	address string
+	wrapTTL string
+	client  *api.Client
+	auth    *vaultAuth
+
+	sync.Mutex
+	// orphanRoles holds when each token role, keyed by Vault namespace
+	// and role, was last seen to create orphan tokens.
+	orphanRoles map[string]time.Time
+}
+
+// vaultBackends holds the configured Vault backends by name.
+type vaultBackends struct {
+	backends    map[string]*vaultBackend
+	defaultName string
+}
+
+// newVaultBackends creates a client for every Vault backend in config and
+// authenticates with each of them. Without configured backends a single
+// backend is set up from VAULT_ADDR and the other standard Vault variables.
+func newVaultBackends(config *Config) (*vaultBackends, error) {
+	vb := &vaultBackends{backends: make(map[string]*vaultBackend)}
+
+	if len(config.Vaults) == 0 {
+		client, err := api.NewClient(api.DefaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		b, err := newVaultBackend(defaultVaultName, client, "", envVaultAuthConfig())
+		if err != nil {
+			return nil, err
+		}
+		vb.backends[b.name] = b
+		vb.defaultName = b.name
+		return vb, nil
+	}
+
+	for _, c := range config.Vaults {
+		vc := api.DefaultConfig()
+		vc.Address = c.Address
+		if c.CACert != "" || c.TLSServerName != "" {
+			err := vc.ConfigureTLS(&api.TLSConfig{CACert: c.CACert, TLSServerName: c.TLSServerName})
+			if err != nil {
+				return nil, fmt.Errorf("vault %s: %v", c.Name, err)
+			}
+		}
+		client, err := api.NewClient(vc)
+		if err != nil {
+			return nil, fmt.Errorf("vault %s: %v", c.Name, err)
+		}
+		// VAULT_TOKEN from the environment belongs to the default backend.
+		client.ClearToken()
+		b, err := newVaultBackend(c.Name, client, c.WrapTTL, c.Auth)
+		if err != nil {
+			return nil, err
+		}
+		vb.backends[b.name] = b
+	}
+	vb.defaultName = config.DefaultVault
+	if vb.defaultName == "" {
+		vb.defaultName = config.Vaults[0].Name
+	}
+	return vb, nil
+}
+
+func newVaultBackend(name string, client *api.Client, wrapTTL string, authConfig VaultAuthConfig) (*vaultBackend, error) {
+	// Only token creation is wrapped; see createWrappedToken.
+	client.SetWrappingLookupFunc(func(operation, path string) string {
+		return ""
+	})
+	auth, err := newVaultAuth(name, client, authConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultBackend{
+		name:        name,
+		address:     client.Address(),
+		wrapTTL:     wrapTTL,
+		client:      client,
+		auth:        auth,
+		orphanRoles: make(map[string]time.Time),
+	}, nil
+}
+
+// Get returns the named backend, or the default backend when name is empty.
+func (vb *vaultBackends) Get(name string) (*vaultBackend, error) {
+	if name == "" {
+		name = vb.defaultName
+	}
+	b, ok := vb.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown vault %q", name)
+	}
+	return b, nil
+}
+
+// Addresses returns the addresses of all backends, sorted.
+func (vb *vaultBackends) Addresses() []string {
+	var addrs []string
+	for _, b := range vb.backends {
+		addrs = append(addrs, b.address)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Run authenticates with every backend and keeps the tokens valid until
+// done is closed.
+func (vb *vaultBackends) Run(done <-chan struct{}) error {
+	for _, b := range vb.backends {
+		secret, err := b.auth.Authenticate()
+		if err != nil {
+			return fmt.Errorf("vault %s: %v", b.name, err)
+		}
+		go b.auth.Run(secret, done)
+	}
+	return nil
+}
+
+// checkRoles warns about the token roles named in the policy ceilings that
+// do not create orphan tokens, so a misconfigured role shows up at startup
+// rather than with the first pod that names it. Roles are read in the
+// parent Vault namespace.
+func (vb *vaultBackends) checkRoles(config *Config) {
+	for _, ceiling := range config.PolicyCeilings {
+		for _, role := range ceiling.Roles {
+			if role == "*" {
+				continue
+			}
+			for _, b := range vb.backends {
+				if err := b.checkOrphanRole(config.VaultNamespaces.Parent, role); err != nil {
+					log.Printf("vault %s: %v; tokens will not be issued through it", b.name, err)
+				}
+			}
+		}
+	}
+}
+
+// checkOrphanRole makes sure the token role in the Vault namespace creates
+// orphan tokens. Vault revokes a token together with its parent, and the
+// controller's own token is replaced whenever it can no longer be renewed,
+// so a pod token that is not an orphan would be revoked along with it.
+func (b *vaultBackend) checkOrphanRole(namespace, role string) error {
+	key := namespace + ":" + role
+	now := time.Now()
+	b.Lock()
+	checked, ok := b.orphanRoles[key]
+	b.Unlock()
+	if ok && now.Sub(checked) < orphanRoleCacheTTL {
+		return nil
+	}
+
+	secret, err := b.clientFor(namespace).Logical().Read("auth/token/roles/" + url.PathEscape(role))
+	if err != nil {
+		return fmt.Errorf("could not read token role %s: %v", role, err)
+	}
+	if secret == nil {
+		return fmt.Errorf("token role %s does not exist", role)
+	}
+	if orphan, _ := secret.Data["orphan"].(bool); !orphan {
+		return fmt.Errorf("token role %s does not create orphan tokens", role)
+	}
+
+	b.Lock()
+	b.orphanRoles[key] = now
+	b.Unlock()
+	return nil
+}
+
+// clientFor returns a client that sends requests to the given Vault
+// namespace, or the backend client itself when namespace is empty.
+func (b *vaultBackend) clientFor(namespace string) *api.Client {
+	if namespace == "" {
+		return b.client
+	}
+	return b.client.WithNamespace(namespace)
+}
+
+// createWrappedToken creates a token in the Vault namespace wrapped for
+// wrapTTL, through the named token role when role is not empty. An empty
+// wrapTTL uses VAULT_WRAP_TTL.
+func (b *vaultBackend) createWrappedToken(namespace string, tcr *api.TokenCreateRequest, role, wrapTTL string) (*api.Secret, error) {
+	path := "/v1/auth/token/create"
+	if role != "" {
+		path += "/" + url.PathEscape(role)
+	}
+	if wrapTTL == "" {
+		wrapTTL = os.Getenv("VAULT_WRAP_TTL")
+	}
+	client := b.clientFor(namespace)
+	r := client.NewRequest("POST", path)
+	r.WrapTTL = wrapTTL
+	if err := r.SetJSONBody(tcr); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.RawRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return api.ParseSecret(resp.Body)
+}
+
+// createToken creates a token in the Vault namespace that is returned to
+// the controller instead of being wrapped.
+func (b *vaultBackend) createToken(namespace string, tcr *api.TokenCreateRequest, role string) (*api.Secret, error) {
+	token := b.clientFor(namespace).Auth().Token()
+	if role != "" {
+		return token.CreateWithRole(tcr, role)
+	}
+	return token.Create(tcr)
+}
+
+// readWrapped reads the secret at path in the Vault namespace with the
+// given token and returns it wrapped for wrapTTL.
+func (b *vaultBackend) readWrapped(namespace, token, path, wrapTTL string) (*api.SecretWrapInfo, error) {
+	client, err := b.clientFor(namespace).CloneWithHeaders()
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+	if wrapTTL == "" {
+		wrapTTL = os.Getenv("VAULT_WRAP_TTL")
+	}
+	r := client.NewRequest("GET", "/v1/"+path)
+	r.WrapTTL = wrapTTL
+
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.WrapInfo == nil {
+		return nil, fmt.Errorf("no wrapped secret returned for %s", path)
+	}
+	return secret.WrapInfo, nil
+}
+
+// revokeAccessor revokes the token in the Vault namespace with the given
+// accessor.
+func (b *vaultBackend) revokeAccessor(namespace, accessor string) error {
+	return b.clientFor(namespace).Auth().Token().RevokeAccessor(accessor)
+}
+
+// wrappingTokenConsumed reports whether the wrapping token in the Vault
+// namespace with the given accessor no longer exists. Before it expires
+// that means it was unwrapped.
+func (b *vaultBackend) wrappingTokenConsumed(namespace, accessor string) (bool, error) {
+	_, err := b.clientFor(namespace).Auth().Token().LookupAccessor(accessor)
+	if err == nil {
+		return false, nil
+	}
+	if isInvalidAccessor(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// wrapExpiry returns the time the wrapping token expires.
+func wrapExpiry(wrapInfo *api.SecretWrapInfo) time.Time {
+	return wrapInfo.CreationTime.Add(time.Duration(wrapInfo.TTL) * time.Second).UTC()
+}
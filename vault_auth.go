@@ -0,0 +1,338 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultLoginRetryDelay       = 10 * time.Second
+)
+
+// vaultAuth keeps the controller's own token for one Vault backend valid.
+// Tokens obtained from AppRole or Kubernetes auth are renewed and replaced by
+// a fresh login once renewal is no longer possible. Static tokens are
+// renewed when they are renewable and re-read whenever the token file
+// changes.
+type vaultAuth struct {
+	name   string
+	client *api.Client
+	config VaultAuthConfig
+
+	// login authenticates with Vault through the given client, which
+	// carries no token; nil for static tokens.
+	login func(client *api.Client) (*api.Secret, error)
+
+	// expires is when the current token expires; zero when it does not.
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// envVaultAuthConfig returns the auth settings for the Vault backend
+// configured through the environment. VAULT_CONTROLLER_AUTH_METHOD selects
+// token (the default), approle or kubernetes.
+func envVaultAuthConfig() VaultAuthConfig {
+	c := VaultAuthConfig{
+		Method:       os.Getenv("VAULT_CONTROLLER_AUTH_METHOD"),
+		Token:        os.Getenv("VAULT_TOKEN"),
+		TokenFile:    os.Getenv("VAULT_TOKEN_FILE"),
+		RoleID:       os.Getenv("VAULT_APPROLE_ROLE_ID"),
+		SecretID:     os.Getenv("VAULT_APPROLE_SECRET_ID"),
+		SecretIDFile: os.Getenv("VAULT_APPROLE_SECRET_ID_FILE"),
+		Role:         os.Getenv("VAULT_KUBERNETES_ROLE"),
+		JWTFile:      os.Getenv("VAULT_KUBERNETES_TOKEN_FILE"),
+	}
+	switch c.Method {
+	case "approle":
+		c.Mount = os.Getenv("VAULT_APPROLE_MOUNT")
+	case "kubernetes":
+		c.Mount = os.Getenv("VAULT_KUBERNETES_MOUNT")
+	}
+	return c
+}
+
+// newVaultAuth returns the auth method described by config for the named
+// backend.
+func newVaultAuth(name string, client *api.Client, config VaultAuthConfig) (*vaultAuth, error) {
+	if config.Method == "" {
+		config.Method = "token"
+	}
+	a := &vaultAuth{name: name, client: client, config: config}
+
+	switch config.Method {
+	case "token":
+		if config.TokenFile == "" && config.Token == "" {
+			return nil, fmt.Errorf("vault %s: token auth requires a token or token file", name)
+		}
+	case "approle":
+		if config.RoleID == "" {
+			return nil, fmt.Errorf("vault %s: approle auth requires a role ID", name)
+		}
+		if config.SecretID == "" && config.SecretIDFile == "" {
+			return nil, fmt.Errorf("vault %s: approle auth requires a secret ID or secret ID file", name)
+		}
+		mount := defaultString(config.Mount, "approle")
+		a.login = func(client *api.Client) (*api.Secret, error) {
+			secretID := config.SecretID
+			if config.SecretIDFile != "" {
+				var err error
+				if secretID, err = readTrimmed(config.SecretIDFile); err != nil {
+					return nil, err
+				}
+			}
+			return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+				"role_id":   config.RoleID,
+				"secret_id": secretID,
+			})
+		}
+	case "kubernetes":
+		if config.Role == "" {
+			return nil, fmt.Errorf("vault %s: kubernetes auth requires a role", name)
+		}
+		mount := defaultString(config.Mount, "kubernetes")
+		jwtFile := defaultString(config.JWTFile, defaultKubernetesTokenFile)
+		a.login = func(client *api.Client) (*api.Secret, error) {
+			jwt, err := readServiceAccountToken(jwtFile)
+			if err != nil {
+				return nil, err
+			}
+			return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+				"role": config.Role,
+				"jwt":  jwt,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("vault %s: unknown auth method %q", name, config.Method)
+	}
+	return a, nil
+}
+
+// Authenticate sets the Vault client token and returns its auth details.
+// Logins go through a clone of the client, so requests in flight keep the
+// current token until a new one is obtained.
+func (a *vaultAuth) Authenticate() (*api.Secret, error) {
+	if a.login != nil {
+		client, err := a.client.CloneWithHeaders()
+		if err != nil {
+			return nil, err
+		}
+		client.ClearToken()
+		secret, err := a.login(client)
+		if err != nil {
+			return nil, fmt.Errorf("%s login failed: %v", a.config.Method, err)
+		}
+		if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+			return nil, fmt.Errorf("%s login returned no token", a.config.Method)
+		}
+		a.client.SetToken(secret.Auth.ClientToken)
+		a.setLease(secret.Auth.LeaseDuration)
+		return secret, nil
+	}
+
+	token := a.config.Token
+	if a.config.TokenFile != "" {
+		var err error
+		if token, err = readTrimmed(a.config.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	a.client.SetToken(token)
+
+	self, err := a.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, fmt.Errorf("error looking up the controller token: %v", err)
+	}
+	ttl, err := self.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	renewable, err := self.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	a.setLease(int(ttl / time.Second))
+	return &api.Secret{
+		Auth: &api.SecretAuth{
+			ClientToken:   token,
+			Renewable:     renewable,
+			LeaseDuration: int(ttl / time.Second),
+		},
+	}, nil
+}
+
+// setLease records the lease duration, in seconds, of the current token.
+func (a *vaultAuth) setLease(seconds int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seconds <= 0 {
+		a.expires = time.Time{}
+		return
+	}
+	a.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// TTL returns the remaining lifetime of the current token, or zero when
+// it does not expire.
+func (a *vaultAuth) TTL() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.expires.IsZero() {
+		return 0
+	}
+	if ttl := time.Until(a.expires); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// Run keeps the token returned by Authenticate valid until done is closed.
+func (a *vaultAuth) Run(secret *api.Secret, done <-chan struct{}) {
+	changed := a.watchTokenFile(done)
+	for {
+		a.keepAlive(secret, changed, done)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var err error
+			secret, err = a.Authenticate()
+			if err == nil {
+				log.Printf("vault auth: %s: authenticated with %s auth", a.name, a.config.Method)
+				break
+			}
+			log.Printf("vault auth: %s: %v; retrying in %v", a.name, err, vaultLoginRetryDelay)
+			select {
+			case <-time.After(vaultLoginRetryDelay):
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// keepAlive renews the token while possible and returns once it has to be
+// replaced.
+func (a *vaultAuth) keepAlive(secret *api.Secret, changed <-chan struct{}, done <-chan struct{}) {
+	if !secret.Auth.Renewable {
+		// Tokens without a TTL, such as root tokens, never expire.
+		var expire <-chan time.Time
+		if secret.Auth.LeaseDuration > 0 {
+			lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+			expire = time.After(lease * 4 / 5)
+		}
+		select {
+		case <-expire:
+			log.Printf("vault auth: %s: token is not renewable and about to expire", a.name)
+		case <-changed:
+			log.Printf("vault auth: %s: token file changed", a.name)
+		case <-done:
+		}
+		return
+	}
+
+	watcher, err := a.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		log.Printf("vault auth: %s: error starting token renewal: %v", a.name, err)
+		return
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Printf("vault auth: %s: token renewal failed: %v", a.name, err)
+			} else {
+				log.Printf("vault auth: %s: token can no longer be renewed", a.name)
+			}
+			return
+		case renewal := <-watcher.RenewCh():
+			log.Printf("vault auth: %s: renewed token at %s", a.name, renewal.RenewedAt.Format(time.RFC3339))
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				a.setLease(renewal.Secret.Auth.LeaseDuration)
+			}
+		case <-changed:
+			log.Printf("vault auth: %s: token file changed", a.name)
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// watchTokenFile signals when the static token file changes. Kubernetes
+// updates mounted Secrets by swapping a symlink, so the directory is watched
+// rather than the file.
+func (a *vaultAuth) watchTokenFile(done <-chan struct{}) <-chan struct{} {
+	if a.config.TokenFile == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("vault auth: %s: error watching %s: %v", a.name, a.config.TokenFile, err)
+		return nil
+	}
+	if err := watcher.Add(filepath.Dir(a.config.TokenFile)); err != nil {
+		log.Printf("vault auth: %s: error watching %s: %v", a.name, a.config.TokenFile, err)
+		watcher.Close()
+		return nil
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-watcher.Events:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err := <-watcher.Errors:
+				log.Printf("vault auth: %s: error watching %s: %v", a.name, a.config.TokenFile, err)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return changed
+}
+
+func defaultString(s, value string) string {
+	if s != "" {
+		return s
+	}
+	return value
+}
+
+func readTrimmed(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+const vaultInitContainerName = "vault-init"
+
+// webhookConfig configures the admission webhook that injects the
+// vault-init container into annotated pods.
+type webhookConfig struct {
+	Addr                string `json:"addr"`
+	TLSCertFile         string `json:"tlsCertFile"`
+	TLSKeyFile          string `json:"tlsKeyFile"`
+	Image               string `json:"image"`
+	ImagePullPolicy     string `json:"imagePullPolicy"`
+	VaultAddr           string `json:"vaultAddr"`
+	VaultControllerAddr string `json:"vaultControllerAddr"`
+	VolumeName          string `json:"volumeName"`
+	MountPath           string `json:"mountPath"`
+
+	// The projected service account token vault-init authenticates with.
+	// TokenAudience defaults to the first audience the controller accepts.
+	TokenAudience          string `json:"tokenAudience"`
+	TokenExpirationSeconds int64  `json:"tokenExpirationSeconds"`
+	TokenVolumeName        string `json:"tokenVolumeName"`
+	TokenMountPath         string `json:"tokenMountPath"`
+}
+
+func loadWebhookConfig(path string) (*webhookConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: could not read config: %v", err)
+	}
+	config := &webhookConfig{
+		Addr:                ":8443",
+		Image:               "kelseyhightower/vault-init:0.0.1",
+		ImagePullPolicy:     "IfNotPresent",
+		VaultAddr:           "http://vault:8200",
+		VaultControllerAddr: "http://vault-controller",
+		VolumeName:          "vault-token",
+		MountPath:           "/var/run/secrets/vaultproject.io",
+
+		TokenExpirationSeconds: 600,
+		TokenVolumeName:        "vault-controller-token",
+		TokenMountPath:         "/var/run/secrets/vault-controller",
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("webhook: could not parse config: %v", err)
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("webhook: tlsCertFile and tlsKeyFile must be set")
+	}
+	// The API server rejects projected tokens that expire in less than ten
+	// minutes.
+	if config.TokenExpirationSeconds < 600 {
+		return nil, fmt.Errorf("webhook: tokenExpirationSeconds must be at least 600")
+	}
+	return config, nil
+}
+
+// startWebhook serves the admission webhook over TLS. The certificate is
+// reloaded when the files change so it can be rotated without a restart.
+func startWebhook(config *webhookConfig) {
+	certs := &certificateReloader{certFile: config.TLSCertFile, keyFile: config.TLSKeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", webhookHandler{config})
+	server := &http.Server{
+		Addr:    config.Addr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+	log.Printf("Listening for admission requests on %s.", config.Addr)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func (cr *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	info, err := os.Stat(cr.certFile)
+	if err != nil {
+		if cr.certificate != nil {
+			return cr.certificate, nil
+		}
+		return nil, fmt.Errorf("webhook: %v", err)
+	}
+	if cr.certificate != nil && !info.ModTime().After(cr.modTime) {
+		return cr.certificate, nil
+	}
+
+	c, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.certificate != nil {
+			log.Printf("webhook: error reloading certificate: %v", err)
+			return cr.certificate, nil
+		}
+		return nil, fmt.Errorf("webhook: error loading certificate: %v", err)
+	}
+	cr.certificate = &c
+	cr.modTime = info.ModTime()
+	return cr.certificate, nil
+}
+
+type webhookHandler struct {
+	config *webhookConfig
+}
+
+func (h webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		log.Printf("webhook: error decoding admission review: %v", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	response := &AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	patch, err := h.mutate(review.Request)
+	if err != nil {
+		// Never block pod creation because of the webhook, vault-init
+		// can still be added by hand.
+		log.Printf("webhook: error mutating pod in %s: %v", review.Request.Namespace, err)
+	} else if len(patch) > 0 {
+		data, err := json.Marshal(patch)
+		if err != nil {
+			log.Printf("webhook: error encoding patch: %v", err)
+		} else {
+			patchType := "JSONPatch"
+			response.Patch = data
+			response.PatchType = &patchType
+		}
+	}
+
+	review.Request = nil
+	review.Response = response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		log.Printf("webhook: error encoding admission review: %v", err)
+	}
+}
+
+// allowedVaultAddrs returns the Vault addresses vault-init accepts in a
+// pushed token: the address it is configured with and that of every Vault
+// the controller issues tokens from.
+func (h webhookHandler) allowedVaultAddrs() []string {
+	addrs := []string{h.config.VaultAddr}
+	if vaults != nil {
+		for _, addr := range vaults.Addresses() {
+			if addr != h.config.VaultAddr {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// tokenAudience returns the audience of the projected service account token
+// injected for vault-init.
+func (h webhookHandler) tokenAudience() string {
+	if h.config.TokenAudience != "" {
+		return h.config.TokenAudience
+	}
+	if len(tokenAudiences) > 0 {
+		return tokenAudiences[0]
+	}
+	return defaultTokenAudience
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// mutate returns the JSON patch that injects vault-init, the token volume
+// and its mounts, and the projected service account token vault-init
+// authenticates with, into the pod. Pods that are granted neither policies nor
+// a token role, or that already run vault-init, are left alone.
+func (h webhookHandler) mutate(request *AdmissionRequest) ([]patchOperation, error) {
+	if request.Kind.Kind != "Pod" || request.Operation != "CREATE" {
+		return nil, nil
+	}
+	var pod AdmissionPod
+	if err := json.Unmarshal(request.Object, &pod); err != nil {
+		return nil, err
+	}
+	candidate := &Pod{Metadata: pod.Metadata}
+	candidate.Metadata.Namespace = request.Namespace
+	candidate.Spec.ServiceAccountName = pod.Spec.ServiceAccountName
+	if resolveGrant(candidate).empty() {
+		return nil, nil
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == vaultInitContainerName {
+			return nil, nil
+		}
+	}
+
+	mount := map[string]interface{}{
+		"name":      h.config.VolumeName,
+		"mountPath": h.config.MountPath,
+	}
+	tokenMount := map[string]interface{}{
+		"name":      h.config.TokenVolumeName,
+		"mountPath": h.config.TokenMountPath,
+		"readOnly":  true,
+	}
+	fieldRef := func(path string) map[string]interface{} {
+		return map[string]interface{}{
+			"fieldRef": map[string]string{"fieldPath": path},
+		}
+	}
+	initContainer := map[string]interface{}{
+		"name":            vaultInitContainerName,
+		"image":           h.config.Image,
+		"imagePullPolicy": h.config.ImagePullPolicy,
+		"env": []map[string]interface{}{
+			{"name": "POD_NAME", "valueFrom": fieldRef("metadata.name")},
+			{"name": "POD_NAMESPACE", "valueFrom": fieldRef("metadata.namespace")},
+			{"name": "VAULT_ADDR", "value": h.config.VaultAddr},
+			{"name": "VAULT_CONTROLLER_ADDR", "value": h.config.VaultControllerAddr},
+			{"name": "VAULT_ALLOWED_ADDRS", "value": strings.Join(h.allowedVaultAddrs(), ",")},
+			{"name": "SERVICE_ACCOUNT_TOKEN_FILE", "value": h.config.TokenMountPath + "/token"},
+		},
+		"volumeMounts": []interface{}{mount, tokenMount},
+	}
+
+	var patch []patchOperation
+
+	// vault-init runs first so the token is in place for any other init
+	// containers.
+	if len(pod.Spec.InitContainers) == 0 {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/initContainers", Value: []interface{}{initContainer}})
+	} else {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/initContainers/0", Value: initContainer})
+	}
+
+	hasVolume := make(map[string]bool)
+	for _, v := range pod.Spec.Volumes {
+		hasVolume[v.Name] = true
+	}
+	volumes := []map[string]interface{}{
+		{
+			"name":     h.config.VolumeName,
+			"emptyDir": map[string]string{"medium": "Memory"},
+		},
+		// Only vault-init mounts the token, so the other containers never
+		// hold a credential the controller accepts.
+		{
+			"name": h.config.TokenVolumeName,
+			"projected": map[string]interface{}{
+				"sources": []interface{}{
+					map[string]interface{}{
+						"serviceAccountToken": map[string]interface{}{
+							"audience":          h.tokenAudience(),
+							"expirationSeconds": h.config.TokenExpirationSeconds,
+							"path":              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+	added := len(pod.Spec.Volumes)
+	for _, volume := range volumes {
+		if hasVolume[volume["name"].(string)] {
+			continue
+		}
+		if added == 0 {
+			patch = append(patch, patchOperation{Op: "add", Path: "/spec/volumes", Value: []interface{}{volume}})
+		} else {
+			patch = append(patch, patchOperation{Op: "add", Path: "/spec/volumes/-", Value: volume})
+		}
+		added++
+	}
+
+	for i, c := range pod.Spec.Containers {
+		mounted := false
+		for _, m := range c.VolumeMounts {
+			if m.Name == h.config.VolumeName || m.MountPath == h.config.MountPath {
+				mounted = true
+			}
+		}
+		if mounted {
+			continue
+		}
+		if len(c.VolumeMounts) == 0 {
+			patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/volumeMounts", i), Value: []interface{}{mount}})
+		} else {
+			patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i), Value: mount})
+		}
+	}
+	return patch, nil
+}
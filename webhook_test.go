@@ -0,0 +1,184 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestWebhookMutate(t *testing.T) {
+	defer func(audiences []string) { tokenAudiences = audiences }(tokenAudiences)
+	tokenAudiences = []string{"vault-controller"}
+
+	h := webhookHandler{&webhookConfig{
+		Image:                  "vault-init",
+		VaultAddr:              "http://vault:8200",
+		VaultControllerAddr:    "http://vault-controller",
+		VolumeName:             "vault-token",
+		MountPath:              "/var/run/secrets/vaultproject.io",
+		TokenExpirationSeconds: 600,
+		TokenVolumeName:        "vault-controller-token",
+		TokenMountPath:         "/var/run/secrets/vault-controller",
+	}}
+	annotated := `"metadata": {"name": "web", "annotations": {"vaultproject.io/policies": "web"}}`
+
+	tests := []struct {
+		name      string
+		operation string
+		pod       string
+		wantPaths []string
+	}{
+		{
+			name:      "bare pod",
+			operation: "CREATE",
+			pod:       `{` + annotated + `, "spec": {"containers": [{"name": "web"}]}}`,
+			wantPaths: []string{"/spec/initContainers", "/spec/volumes", "/spec/volumes/-", "/spec/containers/0/volumeMounts"},
+		},
+		{
+			name:      "existing init containers, volumes and mounts",
+			operation: "CREATE",
+			pod: `{` + annotated + `, "spec": {
+				"initContainers": [{"name": "migrate"}],
+				"volumes": [{"name": "data"}],
+				"containers": [{"name": "web", "volumeMounts": [{"name": "data", "mountPath": "/data"}]}, {"name": "proxy"}]}}`,
+			wantPaths: []string{"/spec/initContainers/0", "/spec/volumes/-", "/spec/volumes/-", "/spec/containers/0/volumeMounts/-", "/spec/containers/1/volumeMounts"},
+		},
+		{
+			name:      "token volume already mounted",
+			operation: "CREATE",
+			pod: `{` + annotated + `, "spec": {
+				"volumes": [{"name": "vault-token"}],
+				"containers": [{"name": "web", "volumeMounts": [{"name": "vault-token", "mountPath": "/vault"}]}]}}`,
+			wantPaths: []string{"/spec/initContainers", "/spec/volumes/-"},
+		},
+		{
+			name:      "vault-init already present",
+			operation: "CREATE",
+			pod:       `{` + annotated + `, "spec": {"initContainers": [{"name": "vault-init"}], "containers": [{"name": "web"}]}}`,
+		},
+		{
+			name:      "no grant",
+			operation: "CREATE",
+			pod:       `{"metadata": {"name": "web"}, "spec": {"containers": [{"name": "web"}]}}`,
+		},
+		{
+			name:      "update",
+			operation: "UPDATE",
+			pod:       `{` + annotated + `, "spec": {"containers": [{"name": "web"}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		request := &AdmissionRequest{
+			Kind:      GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: tt.operation,
+			Object:    json.RawMessage(tt.pod),
+		}
+		patch, err := h.mutate(request)
+		if err != nil {
+			t.Errorf("%s: mutate() returned error: %v", tt.name, err)
+			continue
+		}
+		var paths []string
+		for _, p := range patch {
+			if p.Op != "add" {
+				t.Errorf("%s: patch operation %q on %s, want add", tt.name, p.Op, p.Path)
+			}
+			paths = append(paths, p.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.wantPaths) {
+			t.Errorf("%s: mutate() patched %v, want %v", tt.name, paths, tt.wantPaths)
+		}
+	}
+}
+
+// Only vault-init mounts the projected service account token, which is
+// issued for the controller audience.
+func TestWebhookMutateTokenVolume(t *testing.T) {
+	defer func(audiences []string) { tokenAudiences = audiences }(tokenAudiences)
+	tokenAudiences = []string{"vault-controller"}
+
+	h := webhookHandler{&webhookConfig{
+		VolumeName:             "vault-token",
+		MountPath:              "/var/run/secrets/vaultproject.io",
+		TokenExpirationSeconds: 600,
+		TokenVolumeName:        "vault-controller-token",
+		TokenMountPath:         "/var/run/secrets/vault-controller",
+	}}
+	request := &AdmissionRequest{
+		Kind:      GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: "CREATE",
+		Object:    json.RawMessage(`{"metadata": {"annotations": {"vaultproject.io/role": "web"}}, "spec": {"containers": [{"name": "web"}]}}`),
+	}
+	patch, err := h.mutate(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Round trip the patch to inspect it the way the API server sees it.
+	data, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []struct {
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		t.Fatal(err)
+	}
+	type mount struct {
+		Name string `json:"name"`
+	}
+	for _, op := range ops {
+		switch op.Path {
+		case "/spec/initContainers":
+			var containers []struct {
+				Name         string  `json:"name"`
+				VolumeMounts []mount `json:"volumeMounts"`
+			}
+			json.Unmarshal(op.Value, &containers)
+			want := []mount{{"vault-token"}, {"vault-controller-token"}}
+			if len(containers) != 1 || !reflect.DeepEqual(containers[0].VolumeMounts, want) {
+				t.Errorf("vault-init mounts %+v, want %+v", containers, want)
+			}
+		case "/spec/volumes/-":
+			var volume struct {
+				Name      string `json:"name"`
+				Projected struct {
+					Sources []struct {
+						ServiceAccountToken struct {
+							Audience          string `json:"audience"`
+							ExpirationSeconds int64  `json:"expirationSeconds"`
+						} `json:"serviceAccountToken"`
+					} `json:"sources"`
+				} `json:"projected"`
+			}
+			json.Unmarshal(op.Value, &volume)
+			if volume.Name != "vault-controller-token" || len(volume.Projected.Sources) != 1 {
+				t.Fatalf("token volume = %s, want a projected vault-controller-token volume", op.Value)
+			}
+			if token := volume.Projected.Sources[0].ServiceAccountToken; token.Audience != "vault-controller" || token.ExpirationSeconds != 600 {
+				t.Errorf("token volume = %s, want audience vault-controller expiring in 600 seconds", op.Value)
+			}
+		case "/spec/containers/0/volumeMounts":
+			var mounts []mount
+			json.Unmarshal(op.Value, &mounts)
+			if want := []mount{{"vault-token"}}; !reflect.DeepEqual(mounts, want) {
+				t.Errorf("application container mounts %+v, want %+v", mounts, want)
+			}
+		}
+	}
+}